@@ -0,0 +1,400 @@
+// -{go fmt %f}
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/K1DV5/dman/dman/download"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	BATCH_EXT   = ".batch" // batch state files, in PART_DIR_NAME
+	BATCH_JOBS  = 3        // simultaneous downloads by default
+	BATCH_CONNS = 8        // connections per download
+	// item states
+	ITEM_DONE    = "done"
+	ITEM_SKIPPED = "skipped"
+	ITEM_FAILED  = "failed"
+	ITEM_PAUSED  = "paused"
+)
+
+// one url in a batch, with its options
+type batchItem struct {
+	Url      string      `json:"url"`
+	Out      string      `json:"out,omitempty"`      // filename given
+	Dir      string      `json:"dir,omitempty"`      // absolute, resolved when loaded
+	Header   http.Header `json:"header,omitempty"`   // extra request headers
+	Checksum string      `json:"checksum,omitempty"` // like sha-256=<hex>
+	Filename string      `json:"filename,omitempty"` // the actual name, once started
+	State    string      `json:"state,omitempty"`    // empty if not yet started
+	Error    string      `json:"error,omitempty"`
+}
+
+type batchResult struct {
+	index int
+	down  *download.Download // even if it couldn't start
+	err   error
+}
+
+// read urls, one per line, each optionally followed by indented options like
+// aria2's input file:
+//
+//	https://example.com/file.iso
+//	  out=name.iso
+//	  dir=isos
+//	  header=Cookie: foo=bar
+//	  checksum=sha-256=<hex>
+func parseBatch(input io.Reader) ([]*batchItem, error) {
+	var items []*batchItem
+	scanner := bufio.NewScanner(input)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' { // a url, the first if there are mirrors
+			items = append(items, &batchItem{Url: strings.Fields(trimmed)[0]})
+			continue
+		}
+		if len(items) == 0 {
+			return nil, fmt.Errorf("Line %d: option without a URL", lineNum)
+		}
+		item := items[len(items)-1]
+		option := strings.SplitN(trimmed, "=", 2)
+		if len(option) < 2 {
+			return nil, fmt.Errorf("Line %d: option should be like name=value", lineNum)
+		}
+		switch value := strings.TrimSpace(option[1]); strings.TrimSpace(option[0]) {
+		case "out":
+			item.Out = value
+		case "dir":
+			item.Dir = value
+		case "header":
+			name, value, err := parseHeader(value)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %v", lineNum, err)
+			}
+			if item.Header == nil {
+				item.Header = http.Header{}
+			}
+			item.Header.Add(name, value)
+		case "checksum":
+			item.Checksum = value
+		default:
+			return nil, fmt.Errorf("Line %d: unknown option '%s'", lineNum, option[0])
+		}
+	}
+	return items, scanner.Err()
+}
+
+// start the download, or resume it if it was started before
+func (item *batchItem) start(id int, opts options) (*download.Download, error) {
+	dir := item.Dir
+	if !filepath.IsAbs(dir) { // from older state files
+		dir = filepath.Join(opts.dir, dir)
+	}
+	if opts.conns == 0 {
+		opts.conns = BATCH_CONNS
+	}
+	d := opts.newDownload(item.Url, id, dir)
+	for name, values := range item.Header {
+		d.Header[name] = values
+	}
+	d.Checksum = item.Checksum
+	if item.Filename != "" {
+		d.Filename = item.Filename
+		if progressFile := d.ProgressFile(); fileExists(progressFile) {
+			return d, d.Resume(progressFile)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return d, err
+	}
+	d.Filename = item.Out
+	return d, d.Start()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func saveBatch(items []*batchItem, stateFile string) error {
+	content, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(stateFile, content, 0666)
+}
+
+// make the dirs of the items absolute under dir, so that the state file can
+// be resumed from anywhere
+func resolveDirs(items []*batchItem, dir string) {
+	for _, item := range items {
+		if !filepath.IsAbs(item.Dir) {
+			item.Dir = filepath.Join(dir, item.Dir)
+		}
+	}
+}
+
+// load the items from the state file of the batch if it was started before
+func loadState(stateFile string) ([]*batchItem, error) {
+	content, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	var items []*batchItem
+	if err := json.Unmarshal(content, &items); err != nil {
+		return nil, fmt.Errorf("Bad batch state '%s': %v", stateFile, err)
+	}
+	fmt.Fprintf(notices, "Resuming batch from '%s'\n", stateFile)
+	return items, nil
+}
+
+// a state file in the part dir of dir named by the hash of dir and the keys,
+// for batches without input files
+func hashedStateFile(dir, prefix string, keys ...string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.Join(append([]string{dir}, keys...), " ")))
+	return filepath.Join(dir, download.PART_DIR_NAME, fmt.Sprintf("%s-%08x%s", prefix, hash.Sum32(), BATCH_EXT))
+}
+
+// read the items from the input file, - for stdin
+func readInput(input string) ([]*batchItem, error) {
+	if input == "-" {
+		return parseBatch(os.Stdin)
+	}
+	file, err := os.Open(input)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseBatch(file)
+}
+
+// the items from the input and url patterns, or from the state file if the
+// same batch was started before. the input can be a state file as well. the
+// state file is kept in the part dir of dir
+func loadBatch(input string, patterns []string, dir string) ([]*batchItem, string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	var stateFile string
+	if strings.HasSuffix(input, BATCH_EXT) {
+		stateFile = input
+	} else if input == "-" {
+		stateFile = filepath.Join(dir, download.PART_DIR_NAME, "stdin"+BATCH_EXT)
+	} else if input != "" {
+		stateFile = filepath.Join(dir, download.PART_DIR_NAME, filepath.Base(input)+BATCH_EXT)
+	} else { // named by the patterns
+		stateFile = hashedStateFile(dir, "pattern", patterns...)
+	}
+	if items, err := loadState(stateFile); err == nil || !os.IsNotExist(err) || input == stateFile {
+		return items, stateFile, err
+	}
+	var items []*batchItem
+	if input != "" {
+		if items, err = readInput(input); err != nil {
+			return nil, "", err
+		}
+	}
+	for _, pattern := range patterns {
+		urls, err := download.ExpandPattern(pattern)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, url := range urls {
+			items = append(items, &batchItem{Url: url})
+		}
+	}
+	resolveDirs(items, dir)
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0755); err != nil {
+		return nil, "", err
+	}
+	return items, stateFile, nil
+}
+
+// run the items concurrently, returns the exit status
+func runBatch(items []*batchItem, stateFile string, jobs int, opts options) int {
+	started := make(chan batchResult)
+	finished := make(chan batchResult)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	timer := time.NewTimer(download.STAT_INTERVAL)
+	defer timer.Stop()
+	active := map[int]*download.Download{}
+	stats := map[int]download.Status{} // latest of the active
+	begins := map[int]time.Time{}      // when each active started
+	var doneBytes int64                // by those done in this run
+	var running, next int
+	var stopping bool
+	startNext := func() {
+		for ; !stopping && running < jobs && next < len(items); next++ {
+			item := items[next]
+			if item.State == ITEM_DONE || item.State == ITEM_SKIPPED {
+				continue
+			}
+			running++
+			go func(index int, item batchItem) {
+				d, err := item.start(index, opts)
+				if err != nil {
+					finished <- batchResult{index: index, down: d, err: err}
+					return
+				}
+				started <- batchResult{index: index, down: d}
+				finished <- batchResult{index: index, down: d, err: <-d.Err}
+			}(next, *item)
+		}
+	}
+	startNext()
+	for running > 0 {
+		select {
+		case result := <-started:
+			items[result.index].Filename = result.down.Filename
+			active[result.index] = result.down
+			begins[result.index] = time.Now()
+			if opts.out != nil {
+				opts.out.started(result.down)
+			}
+			if stopping {
+				result.down.Pause()
+			}
+		case result := <-finished:
+			running--
+			delete(active, result.index)
+			delete(stats, result.index)
+			item := items[result.index]
+			item.Error = ""
+			switch result.err {
+			case nil:
+				item.State = ITEM_DONE
+				doneBytes += result.down.Length
+				item.Filename = result.down.Filename // may be changed by the hooks
+			case download.SkippedError:
+				item.State = ITEM_SKIPPED
+			case download.PausedError, download.DiskFullError:
+				item.State = ITEM_PAUSED
+			case download.ChecksumError: // corrupt, download again next time
+				os.Remove(filepath.Join(result.down.Dir, result.down.Filename))
+				item.State, item.Filename, item.Error = ITEM_FAILED, "", result.err.Error()
+			default:
+				item.State = ITEM_FAILED
+				item.Error = result.err.Error()
+			}
+			if opts.out != nil {
+				var duration time.Duration // zero if it failed to start
+				if begin, ok := begins[result.index]; ok {
+					duration = time.Since(begin)
+				}
+				opts.out.result(result.down, result.err, duration)
+			} else {
+				fmt.Printf("\r%s: %s %s%s\n", item.State, item.Url, item.Error, strings.Repeat(" ", 20))
+				for _, warning := range result.down.Warnings {
+					fmt.Println("Warning:", warning)
+				}
+			}
+			delete(begins, result.index)
+			if err := saveBatch(items, stateFile); err != nil {
+				fmt.Fprintf(notices, "Saving batch state failed: %v\n", err)
+			}
+			startNext()
+		case <-interrupt:
+			if stopping {
+				continue
+			}
+			stopping = true
+			fmt.Fprintln(notices, "\rStopping...")
+			for _, d := range active {
+				d.Pause() // may have just ended
+			}
+		case <-timer.C:
+			for index, d := range active {
+				select {
+				case stat := <-d.Status:
+					stats[index] = stat
+					if opts.out != nil {
+						opts.out.progress(stat)
+					}
+				default:
+				}
+			}
+			if opts.out != nil {
+				timer.Reset(download.STAT_INTERVAL)
+				continue
+			}
+			// aggregate
+			written, rate := doneBytes, int64(0)
+			var indexes []int
+			for index, stat := range stats {
+				written += stat.Bytes
+				rate += stat.Rate
+				indexes = append(indexes, index)
+			}
+			sort.Ints(indexes)
+			var progress []string
+			for _, index := range indexes {
+				if percent := stats[index].Percent; percent < 0 { // unknown length
+					progress = append(progress, "?%")
+				} else {
+					progress = append(progress, fmt.Sprintf("%.0f%%", percent))
+				}
+			}
+			fmt.Printf("\r%d/%d done, %s at %s/s, active: %s"+strings.Repeat(" ", 10),
+				countState(items, ITEM_DONE, ITEM_SKIPPED), len(items),
+				download.ReadableSize(written), download.ReadableSize(rate), strings.Join(progress, " "))
+			timer.Reset(download.STAT_INTERVAL)
+		}
+	}
+	// summary
+	done, skipped := countState(items, ITEM_DONE), countState(items, ITEM_SKIPPED)
+	failed, paused := countState(items, ITEM_FAILED), countState(items, ITEM_PAUSED)
+	remaining := len(items) - done - skipped - failed - paused
+	if opts.out != nil {
+		event := jsonEvent{Event: "summary", Counts: map[string]int{
+			ITEM_DONE: done, ITEM_SKIPPED: skipped, ITEM_FAILED: failed, ITEM_PAUSED: paused, "remaining": remaining,
+		}}
+		if done+skipped < len(items) {
+			event.ProgressFile = stateFile
+		}
+		opts.out.emit(event)
+	} else {
+		fmt.Printf("\rDone: %d, skipped: %d, failed: %d, paused: %d, not started: %d%s\n", done, skipped, failed, paused, remaining, strings.Repeat(" ", 20))
+	}
+	if done+skipped == len(items) {
+		os.Remove(stateFile)
+		os.Remove(download.PART_DIR_NAME) // only if empty
+		return EXIT_COMPLETED
+	}
+	fmt.Fprintf(notices, "Resume the batch with 'dman resume %s'\n", stateFile)
+	if failed > 0 && paused+remaining == 0 {
+		return EXIT_FAILED
+	}
+	return EXIT_PAUSED
+}
+
+func countState(items []*batchItem, states ...string) int {
+	var count int
+	for _, item := range items {
+		for _, state := range states {
+			if item.State == state {
+				count++
+			}
+		}
+	}
+	return count
+}
@@ -0,0 +1,712 @@
+// -{go fmt %f}
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/K1DV5/dman/dman/download"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_CONNS = 32 // for a single download
+	// exit statuses
+	EXIT_COMPLETED = 0
+	EXIT_FAILED    = 1 // some downloads failed
+	EXIT_PAUSED    = 2 // stopped before all were done, can be resumed
+	EXIT_USAGE     = 3 // bad command or options
+)
+
+const USAGE = `Usage: dman <command> [options] [arguments]
+
+Commands:
+  get [options] <url>...     download files, the default if given a url
+  resume [options] <file>    continue from a progress or batch state file
+  curl [options] '<command>' download a request copied as cURL or HAR from the browser
+  list [dir]                 list the partial downloads in the dir
+  partials [-r] [dir]        list the partial downloads and stray parts under the dir
+  clean [options] [dir]      remove the partial downloads in the dir
+  info <url>                 show the file name, size and whether it can be resumed
+  tui [options] [url]...     full screen interface for the downloads in a dir
+  setup [options]            register as the native host of the browser extension
+  uninstall [options]        unregister from the browser extension
+  help                       show this help
+
+Run 'dman <command> -h' for the options of a command.
+Exit statuses: 0 completed, 1 failed, 2 paused or incomplete, 3 usage error.
+`
+
+// options shared by the downloads of a command
+type options struct {
+	conns   int
+	dir     string
+	header  http.Header
+	limit   int64 // bytes per second
+	extract bool
+	hooks   []download.Hook
+	out     *jsonOutput // nil for text output
+	// cookies.txt, loaded into jar and written back if saveCookies, with
+	// the session cookies if sessionCookies
+	cookies        string
+	saveCookies    bool
+	sessionCookies bool
+	jar            *download.CookieJar
+	// for the servers that ask, from -user, -bearer or .netrc
+	user        string // name:password
+	credentials download.Credentials
+	netrc       bool
+	prompt      bool // ask for them on the terminal if needed
+}
+
+// whether the credentials can be asked on the terminal, not while the
+// progress is shown and the keys are read
+var canPrompt int32 = 1
+
+// a new download with the options applied
+func (opts options) newDownload(url string, id int, dir string) *download.Download {
+	d := download.New(url, opts.conns, id, dir)
+	d.Header = http.Header{}
+	for name, values := range opts.header {
+		d.Header[name] = values
+	}
+	d.SetLimit(opts.limit)
+	d.Extract, d.Hooks = opts.extract, opts.hooks
+	if opts.jar != nil {
+		d.Jar = opts.jar
+	}
+	d.Credentials, d.Netrc = opts.credentials, opts.netrc
+	if opts.prompt && opts.out == nil {
+		d.AskCredentials = promptCredentials
+	}
+	return d
+}
+
+// ask for the credentials on the terminal
+func promptCredentials(realm string) (download.Credentials, error) {
+	if atomic.LoadInt32(&canPrompt) == 0 {
+		return download.Credentials{}, fmt.Errorf("Credentials needed, give them with -user")
+	}
+	input := bufio.NewReader(os.Stdin)
+	fmt.Printf("\rThe server asks for credentials for '%s'\nUser: ", realm)
+	user, err := input.ReadString('\n')
+	if err != nil {
+		return download.Credentials{}, err
+	}
+	password, err := readPassword(input)
+	return download.Credentials{User: strings.TrimSpace(user), Password: password}, err
+}
+
+func readPassword(input *bufio.Reader) (string, error) {
+	fmt.Print("Password: ")
+	restore := noEcho() // platform dependent
+	password, err := input.ReadString('\n')
+	restore()
+	fmt.Println()
+	return strings.TrimRight(password, "\r\n"), err
+}
+
+// repeatable --header "Name: value"
+type headerFlag http.Header
+
+func (header headerFlag) String() string {
+	return ""
+}
+
+func (header headerFlag) Set(line string) error {
+	name, value, err := parseHeader(line)
+	if err != nil {
+		return err
+	}
+	http.Header(header).Add(name, value)
+	return nil
+}
+
+func parseHeader(line string) (string, string, error) {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) < 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", "", fmt.Errorf("Header should be like 'Name: value', got '%s'", line)
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
+}
+
+// like 500K, 2M or 1G, plain bytes without a suffix
+func parseSize(size string) (int64, error) {
+	size = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	multiplier := int64(1)
+	for suffix, mult := range map[string]int64{"K": download.KB, "M": download.MB, "G": download.GB} {
+		if strings.HasSuffix(size, suffix) {
+			size, multiplier = strings.TrimSuffix(size, suffix), mult
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Bad size '%s'", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// parse the flags, allowing them after the arguments as well
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if args = flags.Args(); len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// the flags of the options shared by get and resume, the string ones are
+// returned to be set in finish()
+func optionFlags(flags *flag.FlagSet, opts *options) (*string, *bool) {
+	flags.IntVar(&opts.conns, "c", 0, fmt.Sprintf("connections per download (default %d, %d in batches)", DEFAULT_CONNS, BATCH_CONNS))
+	flags.Var(headerFlag(opts.header), "header", "extra request header like 'Name: value', can be repeated")
+	flags.BoolVar(&opts.extract, "x", false, "extract archives when done")
+	flags.StringVar(&opts.cookies, "cookies", "", "Netscape cookies.txt file, like those exported from browsers")
+	flags.BoolVar(&opts.saveCookies, "save-cookies", false, "write the updated cookies back to the -cookies file when done")
+	flags.BoolVar(&opts.sessionCookies, "keep-session-cookies", false, "save the session cookies as well with -save-cookies")
+	flags.StringVar(&opts.user, "user", "", "name:password for the servers that ask, the password is asked if not given")
+	flags.StringVar(&opts.credentials.Token, "bearer", "", "token to send as the authorization")
+	flags.BoolVar(&opts.netrc, "netrc", false, "take the credentials from ~/.netrc")
+	jsonLines := flags.Bool("json", false, "print progress and results as JSON lines")
+	return flags.String("limit", "", "speed limit per download like 500K or 2M"), jsonLines
+}
+
+// make the flags set and the options, the usage error is printed
+func newFlags(name, usage string) (*flag.FlagSet, *options) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: dman %s\n\nOptions:\n", usage)
+		flags.PrintDefaults()
+	}
+	return flags, &options{dir: ".", header: http.Header{}}
+}
+
+// set the parsed limit and output, the credentials, load the cookies and the
+// hooks. returns the exit status on errors
+func (opts *options) finish(limit string, jsonLines bool) int {
+	if jsonLines {
+		opts.out = newJsonOutput()
+	}
+	if limit != "" {
+		var err error
+		if opts.limit, err = parseSize(limit); err != nil {
+			fmt.Fprintln(notices, "Error:", err)
+			return EXIT_USAGE
+		}
+	}
+	if opts.user != "" {
+		parts := strings.SplitN(opts.user, ":", 2)
+		opts.credentials.User = parts[0]
+		if len(parts) == 2 {
+			opts.credentials.Password = parts[1]
+		} else if password, err := readPassword(bufio.NewReader(os.Stdin)); err == nil {
+			opts.credentials.Password = password
+		} else {
+			fmt.Fprintln(notices, "Error:", err)
+			return EXIT_USAGE
+		}
+	}
+	if opts.cookies != "" {
+		jar, err := download.LoadCookies(opts.cookies)
+		if err != nil {
+			fmt.Fprintln(notices, "Error:", err)
+			return EXIT_FAILED
+		}
+		opts.jar = jar
+	} else if opts.saveCookies {
+		fmt.Fprintln(notices, "Error: -save-cookies needs -cookies")
+		return EXIT_USAGE
+	}
+	if opts.sessionCookies && !opts.saveCookies {
+		fmt.Fprintln(notices, "Error: -keep-session-cookies needs -save-cookies")
+		return EXIT_USAGE
+	}
+	hooks, err := loadHooks()
+	if err != nil {
+		fmt.Fprintln(notices, "Error:", err)
+		return EXIT_FAILED
+	}
+	opts.hooks = hooks
+	return EXIT_COMPLETED
+}
+
+// write the cookies back if asked, after the downloads
+func (opts *options) storeCookies() {
+	if opts.jar == nil || !opts.saveCookies {
+		return
+	}
+	if err := opts.jar.Save(opts.cookies, opts.sessionCookies); err != nil {
+		fmt.Fprintln(notices, "Error saving cookies:", err)
+	}
+}
+
+func cmdGet(args []string) int {
+	flags, opts := newFlags("get", "get [options] <url or pattern like file_[001-100].jpg>...")
+	limit, jsonLines := optionFlags(flags, opts)
+	flags.StringVar(&opts.dir, "d", ".", "directory to save to")
+	out := flags.String("o", "", "file name to save as, for a single url")
+	checksum := flags.String("checksum", "", "to verify a single url's file, like sha-256=<hex>")
+	input := flags.String("i", "", "file with urls, one per line, - for stdin")
+	jobs := flags.Int("j", BATCH_JOBS, "simultaneous downloads in batches")
+	mirror := flags.String("m", "", "page or directory listing to mirror")
+	depth := flags.Int("depth", MIRROR_DEPTH, "levels of pages to follow when mirroring")
+	accept := flags.String("accept", "", "comma separated file name patterns to mirror")
+	reject := flags.String("reject", "", "comma separated file name patterns not to mirror")
+	domains := flags.String("domains", "", "comma separated other hosts to follow when mirroring")
+	parents := flags.Bool("parents", false, "follow links above the start directory when mirroring")
+	robots := flags.Bool("robots", false, "respect robots.txt when mirroring")
+	urls, err := parseFlags(flags, args)
+	if err != nil {
+		return EXIT_USAGE
+	} else if (*input == "" && *mirror == "" && len(urls) == 0) || *jobs < 1 || opts.conns < 0 {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+	if status := opts.finish(*limit, *jsonLines); status != EXIT_COMPLETED {
+		return status
+	}
+	defer opts.storeCookies()
+	single := *input == "" && *mirror == "" && len(urls) == 1 && !strings.ContainsAny(urls[0], "[{")
+	if !single {
+		if *out != "" || *checksum != "" {
+			fmt.Fprintln(notices, "Error: -o and -checksum are only for a single url")
+			return EXIT_USAGE
+		}
+		var items []*batchItem
+		var stateFile string
+		if *mirror != "" {
+			crawler := download.Crawler{
+				Depth:   *depth,
+				Domains: splitList(*domains),
+				Parents: *parents,
+				Include: splitList(*accept),
+				Exclude: splitList(*reject),
+				Robots:  *robots,
+				Header:  opts.header,
+			}
+			if opts.jar != nil {
+				crawler.Jar = opts.jar
+			}
+			items, stateFile, err = loadMirror(*mirror, opts.dir, &crawler)
+		} else {
+			items, stateFile, err = loadBatch(*input, urls, opts.dir)
+		}
+		if err != nil {
+			fmt.Fprintln(notices, "Error:", err)
+			return EXIT_FAILED
+		}
+		return runBatch(items, stateFile, *jobs, *opts)
+	}
+	if opts.conns == 0 {
+		opts.conns = DEFAULT_CONNS
+	}
+	if err := os.MkdirAll(opts.dir, 0755); err != nil {
+		fmt.Fprintln(notices, "Error:", err)
+		return EXIT_FAILED
+	}
+	opts.prompt = true
+	d := opts.newDownload(urls[0], 0, opts.dir)
+	d.Filename, d.Checksum = *out, *checksum
+	return startSingle(d, *opts)
+}
+
+// start a single download and show its progress, returns the exit status
+func startSingle(d *download.Download, opts options) int {
+	if opts.out != nil {
+		if err := d.Start(); err != nil {
+			return opts.out.result(d, err, 0)
+		}
+		return runSingleJSON(d, opts.out)
+	}
+	fmt.Print("Starting...")
+	if err := d.Start(); err == download.SkippedError {
+		fmt.Printf("\r'%s' is already downloaded.\n", d.Filename)
+		return EXIT_COMPLETED
+	} else if err != nil {
+		fmt.Printf("\rError: %s\n", err.Error())
+		return EXIT_FAILED
+	}
+	return runSingle(d)
+}
+
+func cmdCurl(args []string) int {
+	flags, opts := newFlags("curl", "curl [options] '<command copied as cURL>'\n       dman curl [options] -har <file>")
+	limit, jsonLines := optionFlags(flags, opts)
+	flags.StringVar(&opts.dir, "d", ".", "directory to save to")
+	out := flags.String("o", "", "file name to save as")
+	har := flags.String("har", "", "request copied as HAR, - for stdin")
+	// the command is taken as it is, only the options before it are dman's
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+	command := flags.Args()
+	if (*har == "") == (len(command) == 0) || opts.conns < 0 {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+	if status := opts.finish(*limit, *jsonLines); status != EXIT_COMPLETED {
+		return status
+	}
+	defer opts.storeCookies()
+	var url string
+	var parsed download.Options
+	var err error
+	if *har != "" {
+		var content []byte
+		if *har == "-" {
+			content, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			content, err = ioutil.ReadFile(*har)
+		}
+		if err == nil {
+			url, parsed, err = download.ParseHAR(content)
+		}
+	} else if len(command) == 1 { // pasted in quotes
+		url, parsed, err = download.ParseCurl(command[0])
+	} else { // split by the shell already
+		url, parsed, err = download.ParseCurlArgs(command)
+	}
+	if err != nil {
+		fmt.Fprintln(notices, "Error:", err)
+		return EXIT_USAGE
+	}
+	if opts.conns == 0 {
+		opts.conns = DEFAULT_CONNS
+	}
+	if err := os.MkdirAll(opts.dir, 0755); err != nil {
+		fmt.Fprintln(notices, "Error:", err)
+		return EXIT_FAILED
+	}
+	opts.prompt = true
+	d := opts.newDownload(url, 0, opts.dir)
+	d.SetOptions(parsed)
+	for name, values := range opts.header { // given here, over the copied ones
+		d.Header[name] = values
+	}
+	if opts.credentials != (download.Credentials{}) {
+		d.Credentials = opts.credentials
+	}
+	d.Filename = *out
+	return startSingle(d, *opts)
+}
+
+func cmdResume(args []string) int {
+	flags, opts := newFlags("resume", "resume [options] <progress file> [new url]\n       dman resume [options] <batch state file>")
+	limit, jsonLines := optionFlags(flags, opts)
+	jobs := flags.Int("j", BATCH_JOBS, "simultaneous downloads in batches")
+	files, err := parseFlags(flags, args)
+	if err != nil {
+		return EXIT_USAGE
+	} else if len(files) == 0 || len(files) > 2 || *jobs < 1 || opts.conns < 0 {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+	if status := opts.finish(*limit, *jsonLines); status != EXIT_COMPLETED {
+		return status
+	}
+	defer opts.storeCookies()
+	if strings.HasSuffix(files[0], BATCH_EXT) {
+		items, err := loadState(files[0])
+		if err != nil {
+			fmt.Fprintln(notices, "Error:", err)
+			return EXIT_FAILED
+		}
+		return runBatch(items, files[0], *jobs, *opts)
+	}
+	if opts.conns == 0 {
+		opts.conns = DEFAULT_CONNS
+	}
+	var url string
+	if len(files) > 1 { // renewed
+		url = files[1]
+	}
+	opts.prompt = true
+	d := opts.newDownload(url, 0, ".")
+	if opts.out != nil {
+		if err := d.Resume(files[0]); err != nil {
+			return opts.out.result(d, err, 0)
+		}
+		return runSingleJSON(d, opts.out)
+	}
+	fmt.Print("Resuming...")
+	if err := d.Resume(files[0]); err != nil { // set url & filename as well
+		fmt.Printf("\rResume error: %s\n", err.Error())
+		return EXIT_FAILED
+	}
+	return runSingle(d)
+}
+
+func cmdList(args []string) int {
+	flags, _ := newFlags("list", "list [dir]")
+	dirs, err := parseFlags(flags, args)
+	if err != nil {
+		return EXIT_USAGE
+	}
+	dir := "."
+	if len(dirs) > 0 {
+		dir = dirs[0]
+	}
+	partials, err := download.ListPartials(dir)
+	if err != nil {
+		fmt.Fprintln(notices, "Error:", err)
+	}
+	if len(partials) == 0 {
+		fmt.Printf("No partial downloads in '%s'\n", dir)
+	}
+	for _, partial := range partials {
+		printPartial(partial)
+	}
+	if err != nil {
+		return EXIT_FAILED
+	}
+	return EXIT_COMPLETED
+}
+
+func printPartial(partial download.Partial) {
+	percent, size := "?", "Unknown"
+	if partial.Length >= 0 {
+		percent = fmt.Sprintf("%.1f", partial.Percent())
+		size = download.ReadableSize(partial.Length)
+	}
+	fmt.Printf("%6s%% %10s %5s  %s\n        %s\n        resume: dman resume %s\n",
+		percent, size, readableAge(partial.Modified), partial.Filename, partial.Url, partial.ProgressFile)
+}
+
+func printStray(stray download.Stray) {
+	fmt.Printf("%7s %10s %5s  %s\n", "stray", download.ReadableSize(stray.Size), readableAge(stray.Modified), stray.Path)
+}
+
+// how long ago, roughly
+func readableAge(modified time.Time) string {
+	age := time.Since(modified)
+	switch {
+	case age >= 24*time.Hour:
+		return fmt.Sprintf("%dd", age/(24*time.Hour))
+	case age >= time.Hour:
+		return fmt.Sprintf("%dh", age/time.Hour)
+	}
+	return fmt.Sprintf("%dm", age/time.Minute)
+}
+
+// like 7d, 12h or 30m
+func parseAge(age string) (time.Duration, error) {
+	if days := strings.TrimSuffix(age, "d"); days != age {
+		if value, err := strconv.ParseFloat(days, 64); err == nil && value >= 0 {
+			return time.Duration(value * float64(24*time.Hour)), nil
+		}
+	} else if value, err := time.ParseDuration(age); err == nil && value >= 0 {
+		return value, nil
+	}
+	return 0, fmt.Errorf("Bad age '%s'", age)
+}
+
+func cmdPartials(args []string) int {
+	flags, _ := newFlags("partials", "partials [-r] [dir]")
+	recursive := flags.Bool("r", false, "look in the subdirs as well")
+	dirs, err := parseFlags(flags, args)
+	if err != nil {
+		return EXIT_USAGE
+	}
+	dir := "."
+	if len(dirs) > 0 {
+		dir = dirs[0]
+	}
+	partials, strays, err := download.ScanPartials(dir, *recursive)
+	if err != nil {
+		fmt.Fprintln(notices, "Error:", err)
+	}
+	if len(partials)+len(strays) == 0 {
+		fmt.Printf("No partial downloads under '%s'\n", dir)
+	}
+	for _, partial := range partials {
+		printPartial(partial)
+	}
+	for _, stray := range strays {
+		printStray(stray)
+	}
+	if err != nil {
+		return EXIT_FAILED
+	}
+	return EXIT_COMPLETED
+}
+
+func cmdClean(args []string) int {
+	flags, _ := newFlags("clean", "clean [options] [dir]")
+	yes := flags.Bool("y", false, "remove without asking")
+	recursive := flags.Bool("r", false, "in the subdirs as well")
+	olderThan := flags.String("older-than", "", "only those not changed for this long, like 7d or 12h")
+	dirs, err := parseFlags(flags, args)
+	if err != nil {
+		return EXIT_USAGE
+	}
+	var minAge time.Duration
+	if *olderThan != "" {
+		if minAge, err = parseAge(*olderThan); err != nil {
+			fmt.Fprintln(notices, "Error:", err)
+			return EXIT_USAGE
+		}
+	}
+	dir := "."
+	if len(dirs) > 0 {
+		dir = dirs[0]
+	}
+	found, foundStrays, err := download.ScanPartials(dir, *recursive)
+	if err != nil {
+		fmt.Fprintln(notices, "Error:", err)
+	}
+	var partials []download.Partial
+	for _, partial := range found {
+		if time.Since(partial.Modified) >= minAge {
+			partials = append(partials, partial)
+		}
+	}
+	var strays []download.Stray
+	for _, stray := range foundStrays {
+		if time.Since(stray.Modified) >= minAge {
+			strays = append(strays, stray)
+		}
+	}
+	if len(partials)+len(strays) == 0 {
+		fmt.Printf("No partial downloads in '%s'\n", dir)
+		return EXIT_COMPLETED
+	}
+	for _, partial := range partials {
+		printPartial(partial)
+	}
+	for _, stray := range strays {
+		printStray(stray)
+	}
+	question := fmt.Sprintf("Remove these %d partial downloads?", len(partials))
+	if len(strays) > 0 {
+		question = fmt.Sprintf("Remove these %d partial downloads and %d stray files?", len(partials), len(strays))
+	}
+	if !*yes && !confirm(question) {
+		return EXIT_COMPLETED
+	}
+	status := EXIT_COMPLETED
+	for _, partial := range partials {
+		if err := partial.Remove(); err == download.ActiveError { // resumed meanwhile
+			fmt.Fprintf(notices, "Skipped '%s', it is downloading\n", partial.Filename)
+		} else if err != nil {
+			fmt.Fprintln(notices, "Error:", err)
+			status = EXIT_FAILED
+		}
+	}
+	for _, stray := range strays {
+		if err := stray.Remove(); err != nil {
+			fmt.Fprintln(notices, "Error:", err)
+			status = EXIT_FAILED
+		}
+	}
+	return status
+}
+
+// ask a yes or no question, no by default
+func confirm(question string) bool {
+	fmt.Print(question + " [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func cmdInfo(args []string) int {
+	flags, opts := newFlags("info", "info [options] <url>")
+	flags.Var(headerFlag(opts.header), "header", "extra request header like 'Name: value', can be repeated")
+	urls, err := parseFlags(flags, args)
+	if err != nil {
+		return EXIT_USAGE
+	} else if len(urls) != 1 {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+	d := opts.newDownload(urls[0], 0, ".")
+	if err := d.Probe(); err != nil {
+		fmt.Fprintln(notices, "Error:", err)
+		return EXIT_FAILED
+	}
+	size := "Unknown"
+	if d.Length >= 0 {
+		size = fmt.Sprintf("%s (%d bytes)", download.ReadableSize(d.Length), d.Length)
+	}
+	resumable := "no"
+	if d.Resumable {
+		resumable = "yes"
+	}
+	fmt.Printf("Name:      %s\nSize:      %s\nResumable: %s\n", d.Filename, size, resumable)
+	return EXIT_COMPLETED
+}
+
+func cmdSetup(name string, args []string) int {
+	var opts setupOptions
+	flags, _ := newFlags(name, name+" [options]")
+	if name == "setup" {
+		flags.StringVar(&opts.id, "id", "", "extension id, asked if not given")
+		flags.StringVar(&opts.firefoxId, "firefox-id", FIREFOX_ID, "extension id in Firefox, empty to not register there")
+	}
+	flags.BoolVar(&opts.system, "system", false, "for all users, may need root")
+	if rest, err := parseFlags(flags, args); err != nil {
+		return EXIT_USAGE
+	} else if len(rest) > 0 {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+	run := setup // platform dependent
+	if name == "uninstall" {
+		run = uninstall
+	}
+	if err := run(opts); err != nil {
+		fmt.Fprintln(notices, "Error:", err)
+		return EXIT_FAILED
+	}
+	return EXIT_COMPLETED
+}
+
+// run the command, returns the exit status
+func runCommand(args []string) int {
+	switch args[0] {
+	case "get":
+		return cmdGet(args[1:])
+	case "resume":
+		return cmdResume(args[1:])
+	case "curl":
+		return cmdCurl(args[1:])
+	case "list":
+		return cmdList(args[1:])
+	case "partials":
+		return cmdPartials(args[1:])
+	case "clean":
+		return cmdClean(args[1:])
+	case "info":
+		return cmdInfo(args[1:])
+	case "tui":
+		return cmdTui(args[1:])
+	case "setup", "uninstall":
+		return cmdSetup(args[0], args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(USAGE)
+		return EXIT_COMPLETED
+	}
+	// shortcuts: dman <url>, dman <progress file> [url], dman -i <file>
+	if ext := filepath.Ext(args[0]); ext == download.PROG_FILE_EXT || ext == BATCH_EXT {
+		return cmdResume(args)
+	} else if strings.HasPrefix(args[0], "-") || strings.Contains(args[0], "://") {
+		return cmdGet(args)
+	}
+	fmt.Printf("Unknown command '%s'\n\n%s", args[0], USAGE)
+	return EXIT_USAGE
+}
@@ -1,6 +1,6 @@
 // -{go build | dman ./.dman/gparted-live-1.0.0-5-i686.iso.0.dman}
 // -{go build | dman http://localhost/gparted-live-1.0.0-5-i686.iso}
-// -{go build | dman ./.dman/gparted-live-1.0.0-5-i686.iso.0.dman http://localhost/foo}
+// -{go build | dman resume ./.dman/gparted-live-1.0.0-5-i686.iso.0.dman http://localhost/foo}
 // -{go fmt %f}
 // -{go install}
 
@@ -11,9 +11,32 @@ import (
 	"github.com/K1DV5/dman/dman/download"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 )
 
+const (
+	// speed limit range changed with keys
+	MIN_KEY_LIMIT = 16 * download.KB
+	MAX_KEY_LIMIT = 16 * download.MB
+	// post download hooks config, beside the executable
+	HOOKS_FNAME = "hooks.json"
+)
+
+// load the hooks from the config file, none if it doesn't exist
+func loadHooks() ([]download.Hook, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := download.LoadHooks(filepath.Join(filepath.Dir(exe), HOOKS_FNAME))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return hooks, err
+}
+
 func showProgress(status chan download.Status) {
 	// max width stat:
 	// 100.00% 1004.43MB 1004.34KB/s x32 10d23h21m23s
@@ -25,54 +48,109 @@ func showProgress(status chan download.Status) {
 	for stat := range status {
 		if stat.Rebuilding {
 			fmt.Printf("\rRebuilding %.0f%%"+strings.Repeat(" ", 29), stat.Percent)
+		} else if stat.Extracting {
+			fmt.Printf("\rExtracting %.0f%%"+strings.Repeat(" ", 29), stat.Percent)
 		} else {
-			fmt.Printf("\r%.2f%% %s %s x%d %s"+strings.Repeat(" ", 19), stat.Percent, stat.Written, stat.Speed, stat.Conns, stat.Eta)
+			var limit string
+			if stat.Limit != "" {
+				limit = " max " + stat.Limit
+			}
+			percent := "?" // unknown length
+			if stat.Percent >= 0 {
+				percent = fmt.Sprintf("%.2f", stat.Percent)
+			}
+			fmt.Printf("\r%s%% %s %s%s x%d %s"+strings.Repeat(" ", 19), percent, stat.Written, stat.Speed, limit, stat.Conns, stat.Eta)
 		}
 	}
 }
 
-func standalone() {
-	d := download.New("", 32, 0, ".")
-	if strings.HasPrefix(os.Args[1], "http://") || strings.HasPrefix(os.Args[1], "https://") { // new
-		fmt.Print("Starting...")
-		d.Url = os.Args[1]
-		if err := d.Start(); err != nil { // set filename as well
-			fmt.Printf("\rError: %s\n", err.Error())
+// change connections and speed limit with keys
+func handleKeys(d *download.Download) {
+	key := make([]byte, 1)
+	for {
+		if _, err := os.Stdin.Read(key); err != nil {
 			return
 		}
-	} else {
-		if len(os.Args) > 2 {
-			d.Url = os.Args[2]
+		switch key[0] {
+		case '+', '=':
+			d.SetMaxConns(d.MaxConns() + 1)
+		case '-', '_':
+			d.SetMaxConns(d.MaxConns() - 1)
+		case '[': // slower
+			if limit := d.Limit(); limit == 0 {
+				d.SetLimit(MAX_KEY_LIMIT)
+			} else if limit > MIN_KEY_LIMIT {
+				d.SetLimit(limit / 2)
+			}
+		case ']': // faster
+			if limit := d.Limit(); limit >= MAX_KEY_LIMIT {
+				d.SetLimit(0)
+			} else if limit > 0 {
+				d.SetLimit(limit * 2)
+			}
+		case 'u':
+			d.SetLimit(0)
 		}
-		fmt.Print("Resuming...")
-		if err := d.Resume(os.Args[1]); err != nil { // set url & filename as well
-			fmt.Printf("\rResume error: %s\n", err.Error())
-			return
+	}
+}
+
+// pass interrupts to the download, warn first if it cannot be resumed
+func confirmStop(d *download.Download, interrupt chan os.Signal) {
+	warned := d.Resumable
+	for range interrupt {
+		if !warned {
+			fmt.Println("\rThis download cannot be resumed, press Ctrl+C again to stop anyway.")
+			warned = true
+			continue
 		}
+		d.Pause() // may have just ended
+		return
 	}
+}
 
+// download a started file with progress and keys, returns the exit status
+func runSingle(d *download.Download) int {
+	atomic.StoreInt32(&canPrompt, 0) // the keys are read from now on
 	fmt.Printf("\rDownloading '%s' press Ctrl+C to stop.\n", d.Filename)
+	fmt.Println("Keys: +/- connections, [/] speed limit, u unlimited.")
 	go showProgress(d.Status)
+	restore := rawInput() // platform dependent
+	defer restore()
+	go handleKeys(d)
 
 	// enable interrupt
-	signal.Notify(d.Stop, os.Interrupt)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go confirmStop(d, interrupt)
 	err := <-d.Err
 
+	progressFile, _ := filepath.Rel(".", d.ProgressFile())
 	if err == nil {
 		fmt.Println("\rFinished", strings.Repeat(" ", 70))
+		for _, warning := range d.Warnings {
+			fmt.Println("Warning:", warning)
+		}
+		return EXIT_COMPLETED
 	} else if err == download.PausedError {
-		fmt.Printf("\rPaused, saved progress to '%s/%s.%d%s'.\n", download.PART_DIR_NAME, d.Filename, d.Id, download.PROG_FILE_EXT)
-	} else {
-		fmt.Printf("\rFailed: %v\nProgress saved to '%s/%s.%d%s'.\n", err, download.PART_DIR_NAME, d.Filename, d.Id, download.PROG_FILE_EXT)
+		fmt.Printf("\rPaused, saved progress to '%s'.\n", progressFile)
+		return EXIT_PAUSED
+	} else if err == download.DiskFullError {
+		fmt.Printf("\rDisk full, paused. Free some space and resume from '%s'.\n", progressFile)
+		return EXIT_PAUSED
 	}
+	fmt.Printf("\rFailed: %v\nProgress saved to '%s'.\n", err, progressFile)
+	return EXIT_FAILED
 }
 
 func main() {
 	if len(os.Args) == 1 {
-		setup() // platform dependent
-	} else if strings.HasPrefix(os.Args[1], "chrome-extension://") {
+		if err := setup(setupOptions{firefoxId: FIREFOX_ID}); err != nil { // platform dependent, asks for the id
+			fmt.Println("Error:", err)
+			os.Exit(EXIT_FAILED)
+		}
+	} else if browserLaunch(os.Args[1:]) {
 		extension()
 	} else {
-		standalone()
+		os.Exit(runCommand(os.Args[1:]))
 	}
 }
@@ -0,0 +1,335 @@
+// -{go fmt %f}
+
+package download
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const MAX_AUTH_TRIES = 3 // answers to the challenges of a request
+
+// Credentials are for the servers that ask for them with 401
+type Credentials struct {
+	User     string
+	Password string
+	Token    string // sent as a bearer token without being asked
+}
+
+// a WWW-Authenticate challenge
+type challenge struct {
+	scheme string // lowercase
+	params map[string]string
+}
+
+// the authentication state of a host
+type hostAuth struct {
+	credentials Credentials
+	challenge   challenge // the last one answered, empty until challenged
+	nonceCount  int       // of the digest nonce, for each request
+}
+
+// the authentication state shared by the connections of a download
+type authState struct {
+	mutex      sync.Mutex
+	hosts      map[string]*hostAuth
+	generation int       // changed with the credentials or a challenge
+	asking     chan bool // closed when AskCredentials returns, nil if not asking
+}
+
+// HasCredentials tells whether there is anything to authenticate with
+func (cred Credentials) HasCredentials() bool {
+	return cred.User != "" || cred.Token != ""
+}
+
+// the state of the host of the request, made with the credentials if new.
+// those given are for the url, the others use only .netrc. call locked
+func (down *Download) hostAuth(req *http.Request) *hostAuth {
+	host := canonicalHost(req.URL.Host)
+	if state := down.auth.hosts[host]; state != nil {
+		return state
+	}
+	state := &hostAuth{}
+	if req.Response == nil { // not redirected
+		state.credentials = down.Credentials
+	}
+	if !state.credentials.HasCredentials() && down.Netrc {
+		state.credentials, _ = ReadNetrc(NetrcPath(), host)
+	}
+	if down.auth.hosts == nil {
+		down.auth.hosts = map[string]*hostAuth{}
+	}
+	down.auth.hosts[host] = state
+	return state
+}
+
+// set the authorization header for the host, returns the generation
+func (down *Download) authorize(req *http.Request) int {
+	auth := &down.auth
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	state := down.hostAuth(req)
+	cred := state.credentials
+	switch {
+	case cred.Token != "":
+		req.Header.Set("Authorization", "Bearer "+cred.Token)
+	case state.challenge.scheme == "basic":
+		req.SetBasicAuth(cred.User, cred.Password)
+	case state.challenge.scheme == "digest": // new for each request, including each connection
+		state.nonceCount++
+		if value, err := digestAuthorization(state.challenge.params, cred, req, state.nonceCount); err == nil {
+			req.Header.Set("Authorization", value)
+		}
+	}
+	return auth.generation
+}
+
+// answer the 401 response of a request authorized with the generation,
+// returns whether to try again
+func (down *Download) answerChallenge(resp *http.Response, generation int) bool {
+	challenges := parseChallenges(resp.Header.Values("Www-Authenticate"))
+	var chosen challenge
+	for _, chal := range challenges { // the strongest supported
+		if chal.scheme == "digest" && digestHash(chal.params["algorithm"]) != nil {
+			chosen = chal
+			break
+		} else if chal.scheme == "basic" && chosen.scheme == "" {
+			chosen = chal
+		}
+	}
+	if chosen.scheme == "" {
+		return false
+	}
+	auth := &down.auth
+	auth.mutex.Lock()
+	if auth.generation != generation { // answered by another connection meanwhile
+		auth.mutex.Unlock()
+		return true
+	}
+	state := down.hostAuth(resp.Request) // the last of the redirects
+	stale := strings.EqualFold(chosen.params["stale"], "true")
+	rejected := state.challenge.scheme != "" && !stale // the credentials were sent
+	if !state.credentials.HasCredentials() || state.credentials.User == "" || rejected {
+		if down.AskCredentials == nil {
+			auth.mutex.Unlock()
+			return false
+		} else if waiting := auth.asking; waiting != nil { // by another connection
+			auth.mutex.Unlock()
+			<-waiting
+			auth.mutex.Lock()
+			answered := auth.generation != generation
+			auth.mutex.Unlock()
+			return answered
+		}
+		done := make(chan bool)
+		auth.asking = done
+		auth.mutex.Unlock() // the other connections go on while asking
+		cred, err := down.AskCredentials(chosen.params["realm"])
+		auth.mutex.Lock()
+		auth.asking = nil
+		close(done)
+		if err != nil || !cred.HasCredentials() {
+			auth.mutex.Unlock()
+			return false
+		}
+		state.credentials = cred
+		if auth.generation != generation { // a newer challenge was answered meanwhile
+			auth.generation++
+			auth.mutex.Unlock()
+			return true
+		}
+	}
+	state.challenge, state.nonceCount = chosen, 0
+	auth.generation++
+	auth.mutex.Unlock()
+	return true
+}
+
+// parse WWW-Authenticate headers, which may have several challenges each
+func parseChallenges(headers []string) []challenge {
+	var challenges []challenge
+	for _, header := range headers {
+		var current *challenge
+		for header = strings.TrimSpace(header); header != ""; header = strings.TrimLeft(header, ", ") {
+			// a token, followed by = for a param or by a space for a scheme
+			end := strings.IndexAny(header, " =,")
+			if end < 0 {
+				end = len(header)
+			}
+			token := header[:end]
+			header = strings.TrimLeft(header[end:], " ")
+			if !strings.HasPrefix(header, "=") { // a new scheme
+				challenges = append(challenges, challenge{scheme: strings.ToLower(token), params: map[string]string{}})
+				current = &challenges[len(challenges)-1]
+				continue
+			}
+			header = strings.TrimLeft(header[1:], " ")
+			var value string
+			if strings.HasPrefix(header, `"`) {
+				var quoted strings.Builder
+				i := 1
+				for ; i < len(header) && header[i] != '"'; i++ {
+					if header[i] == '\\' && i+1 < len(header) {
+						i++
+					}
+					quoted.WriteByte(header[i])
+				}
+				if i < len(header) { // the closing quote
+					i++
+				}
+				value, header = quoted.String(), header[i:]
+			} else {
+				end := strings.IndexByte(header, ',')
+				if end < 0 {
+					end = len(header)
+				}
+				value, header = strings.TrimSpace(header[:end]), header[end:]
+			}
+			if current != nil {
+				current.params[strings.ToLower(token)] = value
+			}
+		}
+	}
+	return challenges
+}
+
+// the hash of a digest algorithm, nil if not supported
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// the Authorization header value answering a digest challenge (RFC 7616)
+func digestAuthorization(params map[string]string, cred Credentials, req *http.Request, nonceCount int) (string, error) {
+	newHash := digestHash(params["algorithm"])
+	if newHash == nil {
+		return "", fmt.Errorf("Unsupported digest algorithm '%s'", params["algorithm"])
+	}
+	digest := func(parts ...string) string {
+		h := newHash()
+		h.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	cnonceBytes := make([]byte, 12)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return "", err
+	}
+	cnonce, nc := hex.EncodeToString(cnonceBytes), fmt.Sprintf("%08x", nonceCount)
+	realm, nonce, uri := params["realm"], params["nonce"], req.URL.RequestURI()
+	ha1 := digest(cred.User, realm, cred.Password)
+	if strings.HasSuffix(strings.ToUpper(params["algorithm"]), "-SESS") {
+		ha1 = digest(ha1, nonce, cnonce)
+	}
+	ha2 := digest(req.Method, uri)
+	var qop string
+	for _, option := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(option) == "auth" {
+			qop = "auth"
+		}
+	}
+	fields := []string{
+		fmt.Sprintf(`username="%s"`, cred.User),
+		fmt.Sprintf(`realm="%s"`, realm),
+		fmt.Sprintf(`nonce="%s"`, nonce),
+		fmt.Sprintf(`uri="%s"`, uri),
+	}
+	if qop == "" { // the old way, without the counts
+		fields = append(fields, fmt.Sprintf(`response="%s"`, digest(ha1, nonce, ha2)))
+	} else {
+		fields = append(fields,
+			fmt.Sprintf(`response="%s"`, digest(ha1, nonce, nc, cnonce, qop, ha2)),
+			"qop="+qop, "nc="+nc, fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	if algorithm := params["algorithm"]; algorithm != "" {
+		fields = append(fields, "algorithm="+algorithm)
+	}
+	if opaque, ok := params["opaque"]; ok {
+		fields = append(fields, fmt.Sprintf(`opaque="%s"`, opaque))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
+
+// NetrcPath gives the .netrc file to use, from $NETRC or in the home dir
+func NetrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	if runtime.GOOS == "windows" {
+		if path := filepath.Join(home, "_netrc"); fileExists(path) {
+			return path
+		}
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// ReadNetrc finds the credentials for the host in a .netrc file, or those of
+// the default entry, empty if neither
+func ReadNetrc(path, host string) (Credentials, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Credentials{}, err
+	}
+	var found, fallback Credentials
+	var current *Credentials
+	var key string // waiting for its value
+	hostFound, inMacro := false, false
+	for _, line := range strings.Split(string(content), "\n") {
+		if inMacro { // until an empty line
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+	fields:
+		for _, field := range strings.Fields(line) {
+			switch {
+			case key == "machine":
+				current, key = nil, ""
+				if !hostFound && strings.EqualFold(field, host) {
+					current, hostFound = &found, true
+				}
+			case key != "":
+				if current != nil && key == "login" {
+					current.User = field
+				} else if current != nil && key == "password" {
+					current.Password = field
+				}
+				key = ""
+			case field == "default":
+				current = &fallback
+			case field == "macdef": // the rest of the line is its name
+				inMacro = true
+				break fields
+			case field == "machine" || field == "login" || field == "password" || field == "account":
+				key = field
+			}
+		}
+	}
+	if hostFound {
+		return found, nil
+	}
+	return fallback, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,68 @@
+// -{go fmt %f}
+
+package download
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// by the names in checksums like "sha-256=<hex>", dashes removed
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// split a checksum like "sha-256=<hex>" to its hash and digest
+func parseChecksum(checksum string) (hash.Hash, []byte, error) {
+	parts := strings.SplitN(checksum, "=", 2)
+	if len(parts) < 2 {
+		return nil, nil, fmt.Errorf("Bad checksum '%s', should be like sha-256=<hex>", checksum)
+	}
+	newHash, ok := checksumHashes[strings.Replace(strings.ToLower(parts[0]), "-", "", -1)]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unsupported checksum type '%s'", parts[0])
+	}
+	digest, err := hex.DecodeString(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Bad checksum digest: %v", err)
+	}
+	return newHash(), digest, nil
+}
+
+// check the complete file against Checksum
+func (down *Download) verifyChecksum() error {
+	if down.Checksum == "" {
+		return nil
+	}
+	hasher, digest, err := parseChecksum(down.Checksum)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filepath.Join(down.Dir, down.Filename))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return err
+	}
+	if !bytes.Equal(hasher.Sum(nil), digest) {
+		return ChecksumError
+	}
+	return nil
+}
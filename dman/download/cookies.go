@@ -0,0 +1,258 @@
+// -{go fmt %f}
+
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	COOKIES_HEADER    = "# Netscape HTTP Cookie File"
+	HTTP_ONLY_PREFIX  = "#HttpOnly_" // before the domain of http only cookies
+	COOKIE_FILE_PARTS = 7
+)
+
+// a cookie in the jar, as in the lines of cookies.txt
+type jarCookie struct {
+	domain   string // without the leading dot
+	hostOnly bool   // not for the subdomains
+	path     string
+	secure   bool
+	httpOnly bool
+	expires  time.Time // zero for session cookies
+	name     string
+	value    string
+}
+
+func (cookie *jarCookie) expired(now time.Time) bool {
+	return !cookie.expires.IsZero() && !cookie.expires.After(now)
+}
+
+func (cookie *jarCookie) matches(u *url.URL, now time.Time) bool {
+	host := canonicalHost(u.Host)
+	if cookie.expired(now) || (cookie.secure && u.Scheme != "https") {
+		return false
+	} else if host != cookie.domain && (cookie.hostOnly || !strings.HasSuffix(host, "."+cookie.domain)) {
+		return false
+	}
+	return pathMatches(requestPath(u), cookie.path)
+}
+
+// CookieJar keeps cookies by domain, path, secure flag and expiry, and can be
+// loaded from and saved to Netscape cookies.txt files, like those exported
+// from browsers or written by curl and wget
+type CookieJar struct {
+	mutex   sync.Mutex
+	cookies []*jarCookie
+}
+
+// LoadCookies reads a cookies.txt file into a new jar
+func LoadCookies(path string) (*CookieJar, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	jar := &CookieJar{}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		httpOnly := strings.HasPrefix(line, HTTP_ONLY_PREFIX)
+		line = strings.TrimPrefix(line, HTTP_ONLY_PREFIX)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, "\t")
+		if len(parts) == COOKIE_FILE_PARTS-1 { // empty value, trimmed
+			parts = append(parts, "")
+		}
+		if len(parts) != COOKIE_FILE_PARTS {
+			return nil, fmt.Errorf("Bad cookie in '%s' line %d", path, lineNum)
+		}
+		expires, err := strconv.ParseInt(parts[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad cookie expiry in '%s' line %d", path, lineNum)
+		}
+		cookie := &jarCookie{
+			domain:   strings.TrimPrefix(strings.ToLower(parts[0]), "."),
+			hostOnly: !strings.EqualFold(parts[1], "TRUE"),
+			path:     parts[2],
+			secure:   strings.EqualFold(parts[3], "TRUE"),
+			httpOnly: httpOnly,
+			name:     parts[5],
+			value:    parts[6],
+		}
+		if expires > 0 {
+			cookie.expires = time.Unix(expires, 0)
+		}
+		jar.set(cookie)
+	}
+	return jar, scanner.Err()
+}
+
+// replace the one with the same domain, path and name, if any
+func (jar *CookieJar) set(cookie *jarCookie) {
+	for i, old := range jar.cookies {
+		if old.domain == cookie.domain && old.path == cookie.path && old.name == cookie.name {
+			jar.cookies[i] = cookie
+			return
+		}
+	}
+	jar.cookies = append(jar.cookies, cookie)
+}
+
+// Cookies gives the cookies to send to the url, those with longer paths first
+func (jar *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	jar.mutex.Lock()
+	defer jar.mutex.Unlock()
+	now := time.Now()
+	var matched []*jarCookie
+	for _, cookie := range jar.cookies {
+		if cookie.matches(u, now) {
+			matched = append(matched, cookie)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return len(matched[i].path) > len(matched[j].path)
+	})
+	var cookies []*http.Cookie
+	for _, cookie := range matched {
+		cookies = append(cookies, &http.Cookie{Name: cookie.name, Value: cookie.value})
+	}
+	return cookies
+}
+
+// SetCookies keeps the cookies set by a response from the url, removing the
+// expired ones
+func (jar *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	jar.mutex.Lock()
+	defer jar.mutex.Unlock()
+	host := canonicalHost(u.Host)
+	now := time.Now()
+	for _, cookie := range cookies {
+		set := &jarCookie{
+			domain:   strings.TrimPrefix(strings.ToLower(cookie.Domain), "."),
+			path:     cookie.Path,
+			secure:   cookie.Secure,
+			httpOnly: cookie.HttpOnly,
+			name:     cookie.Name,
+			value:    cookie.Value,
+		}
+		if set.domain == "" || set.domain == host {
+			set.domain, set.hostOnly = host, set.domain == ""
+		} else if !strings.HasSuffix(host, "."+set.domain) || net.ParseIP(host) != nil {
+			continue // for another site
+		} else if !strings.Contains(set.domain, ".") {
+			continue // for a whole top level domain like com
+		}
+		if set.path == "" || !strings.HasPrefix(set.path, "/") {
+			set.path = defaultPath(u)
+		}
+		switch {
+		case cookie.MaxAge < 0:
+			set.expires = now // remove
+		case cookie.MaxAge > 0:
+			set.expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		case !cookie.Expires.IsZero():
+			set.expires = cookie.Expires
+		}
+		jar.set(set)
+	}
+	var kept []*jarCookie
+	for _, cookie := range jar.cookies {
+		if !cookie.expired(now) {
+			kept = append(kept, cookie)
+		}
+	}
+	jar.cookies = kept
+}
+
+// Save writes the cookies that are not expired to a cookies.txt file, only
+// readable by the user. session cookies are left out unless session is set
+func (jar *CookieJar) Save(path string, session bool) error {
+	jar.mutex.Lock()
+	defer jar.mutex.Unlock()
+	var content bytes.Buffer
+	content.WriteString(COOKIES_HEADER + "\n\n")
+	now := time.Now()
+	for _, cookie := range jar.cookies {
+		if cookie.expired(now) || (cookie.expires.IsZero() && !session) {
+			continue
+		}
+		domain, subdomains := cookie.domain, "FALSE"
+		if !cookie.hostOnly {
+			domain, subdomains = "."+domain, "TRUE"
+		}
+		if cookie.httpOnly {
+			domain = HTTP_ONLY_PREFIX + domain
+		}
+		secure := "FALSE"
+		if cookie.secure {
+			secure = "TRUE"
+		}
+		var expires int64
+		if !cookie.expires.IsZero() {
+			expires = cookie.expires.Unix()
+		}
+		fmt.Fprintf(&content, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", domain, subdomains, cookie.path, secure, expires, cookie.name, cookie.value)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// the mode is only set when created
+	if err := os.Chmod(path, 0600); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(content.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// the host without the port, lowercase
+func canonicalHost(host string) string {
+	if withoutPort, _, err := net.SplitHostPort(host); err == nil {
+		host = withoutPort
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func requestPath(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// the dir of the request path, for cookies set without a path
+func defaultPath(u *url.URL) string {
+	path := requestPath(u)
+	if i := strings.LastIndex(path, "/"); i > 0 {
+		return path[:i]
+	}
+	return "/"
+}
+
+// whether the request path is the cookie's or below it
+func pathMatches(requestPath, cookiePath string) bool {
+	if requestPath == cookiePath {
+		return true
+	} else if !strings.HasPrefix(requestPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || requestPath[len(cookiePath)] == '/'
+}
@@ -0,0 +1,259 @@
+// -{go fmt %f}
+
+package download
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	MAX_CRAWL_URLS = 100000  // visited pages and files in one crawl
+	MAX_PAGE_SIZE  = 10 * MB // html read to find links
+	ROBOTS_AGENT   = "dman"  // our name in robots.txt
+)
+
+// links in html pages and autoindex listings
+var linkPattern = regexp.MustCompile(`(?i)<a\s[^>]*?href\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+// extensions of links that are fetched as pages, others are files
+var pageExts = map[string]bool{"": true, ".html": true, ".htm": true, ".xhtml": true, ".php": true, ".asp": true, ".aspx": true, ".jsp": true}
+
+// Crawler finds the files linked from a page or directory listing, following
+// the links to other pages within the limits
+type Crawler struct {
+	Depth   int         // levels of pages to follow from the start page
+	Domains []string    // hosts to follow, only the start's if empty
+	Parents bool        // follow links above the start's directory
+	Include []string    // file name patterns to take, all if empty
+	Exclude []string    // file name patterns to skip
+	Robots  bool        // respect robots.txt Disallow rules
+	Header  http.Header // extra request headers
+	Jar     http.CookieJar
+	start   *url.URL
+	base    string              // the start's directory
+	robots  map[string][]string // disallowed path prefixes by host
+}
+
+type CrawledFile struct {
+	Url  string
+	Path string // relative, keeping the directory structure
+}
+
+type crawlPage struct {
+	url   *url.URL
+	depth int
+}
+
+// Crawl returns the files found, breadth first from the start url
+func (crawler *Crawler) Crawl(start string) ([]CrawledFile, error) {
+	startUrl, err := url.Parse(start)
+	if err != nil {
+		return nil, err
+	} else if startUrl.Scheme != "http" && startUrl.Scheme != "https" {
+		return nil, fmt.Errorf("Not an http url: '%s'", start)
+	}
+	crawler.start, crawler.robots = startUrl, map[string][]string{}
+	crawler.base = startUrl.Path
+	if !strings.HasSuffix(crawler.base, "/") {
+		crawler.base = path.Dir(crawler.base) + "/"
+	}
+	visited := map[string]bool{startUrl.String(): true}
+	queue := []crawlPage{{startUrl, 0}}
+	var files []CrawledFile
+	for len(queue) > 0 {
+		page := queue[0]
+		queue = queue[1:]
+		links, isPage, err := crawler.fetchLinks(page.url)
+		if err != nil {
+			if page.depth == 0 {
+				return nil, err
+			}
+			continue // broken links are skipped
+		}
+		if !isPage { // it was a file after all
+			if file, ok := crawler.file(page.url); ok {
+				files = append(files, file)
+			}
+			continue
+		}
+		for _, link := range links {
+			if visited[link.String()] || len(visited) >= MAX_CRAWL_URLS || !crawler.allowed(link) {
+				continue
+			}
+			visited[link.String()] = true
+			if strings.HasSuffix(link.Path, "/") || pageExts[strings.ToLower(path.Ext(link.Path))] {
+				if page.depth < crawler.Depth {
+					queue = append(queue, crawlPage{link, page.depth + 1})
+				}
+			} else if file, ok := crawler.file(link); ok {
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
+
+func (crawler *Crawler) get(pageUrl string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", pageUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range crawler.Header {
+		req.Header[name] = values
+	}
+	client := http.DefaultClient
+	if crawler.Jar != nil {
+		client = &http.Client{Jar: crawler.Jar}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Bad response for '%s': %s", pageUrl, resp.Status)
+	}
+	return resp, nil
+}
+
+// the links in the page, or false if it's not html
+func (crawler *Crawler) fetchLinks(pageUrl *url.URL) ([]*url.URL, bool, error) {
+	resp, err := crawler.get(pageUrl.String())
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "text/html") && !strings.Contains(contentType, "xhtml") {
+		return nil, false, nil
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_PAGE_SIZE))
+	if err != nil {
+		return nil, true, err
+	}
+	final := resp.Request.URL // after redirects
+	var links []*url.URL
+	for _, match := range linkPattern.FindAllStringSubmatch(string(content), -1) {
+		ref, err := url.Parse(html.UnescapeString(match[1] + match[2] + match[3]))
+		if err != nil {
+			continue
+		}
+		link := final.ResolveReference(ref)
+		link.Fragment = ""
+		if link.Path == final.Path { // like the sorting links in listings
+			continue
+		}
+		links = append(links, link)
+	}
+	return links, true, nil
+}
+
+// whether the link is within the limits
+func (crawler *Crawler) allowed(link *url.URL) bool {
+	if link.Scheme != "http" && link.Scheme != "https" {
+		return false
+	}
+	if link.Host == crawler.start.Host {
+		if !crawler.Parents && !strings.HasPrefix(link.Path, crawler.base) {
+			return false
+		}
+	} else if !inList(link.Host, crawler.Domains) {
+		return false
+	}
+	if crawler.Robots {
+		for _, prefix := range crawler.disallowed(link) {
+			if strings.HasPrefix(link.Path, prefix) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func inList(item string, list []string) bool {
+	for _, listItem := range list {
+		if item == listItem {
+			return true
+		}
+	}
+	return false
+}
+
+// the file if its name is included and not excluded
+func (crawler *Crawler) file(link *url.URL) (CrawledFile, bool) {
+	name := path.Base(link.Path)
+	if len(crawler.Include) > 0 && !matchAny(name, crawler.Include) || matchAny(name, crawler.Exclude) {
+		return CrawledFile{}, false
+	}
+	relPath := link.Host + link.Path // other hosts and parents
+	if link.Host == crawler.start.Host && strings.HasPrefix(link.Path, crawler.base) {
+		relPath = strings.TrimPrefix(link.Path, crawler.base)
+	}
+	relPath = path.Clean("/" + relPath)[1:] // no ..
+	if relPath == "" {
+		return CrawledFile{}, false
+	}
+	return CrawledFile{Url: link.String(), Path: relPath}, true
+}
+
+func matchAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// the Disallow rules for us or for all agents in the robots.txt of the host
+func (crawler *Crawler) disallowed(link *url.URL) []string {
+	if rules, ok := crawler.robots[link.Host]; ok {
+		return rules
+	}
+	var rules []string
+	crawler.robots[link.Host] = rules // no rules if it can't be read
+	resp, err := crawler.get(link.Scheme + "://" + link.Host + "/robots.txt")
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, MAX_PAGE_SIZE))
+	var applies, inAgents bool
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		field := strings.SplitN(line, ":", 2)
+		if len(field) < 2 {
+			continue
+		}
+		name, value := strings.ToLower(strings.TrimSpace(field[0])), strings.TrimSpace(field[1])
+		switch name {
+		case "user-agent":
+			if !inAgents { // a new group
+				applies = false
+			}
+			inAgents = true
+			agent := strings.ToLower(value)
+			applies = applies || agent == "*" || strings.Contains(agent, ROBOTS_AGENT)
+		case "disallow":
+			inAgents = false
+			if applies && value != "" {
+				rules = append(rules, value)
+			}
+		default:
+			inAgents = false
+		}
+	}
+	crawler.robots[link.Host] = rules
+	return rules
+}
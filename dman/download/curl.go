@@ -0,0 +1,393 @@
+// -{go fmt %f}
+
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// curl options that don't change the request, with whether they take a value
+var curlIgnored = map[string]bool{
+	"--compressed": false, "-k": false, "--insecure": false, "-L": false, "--location": false,
+	"-s": false, "--silent": false, "-S": false, "--show-error": false, "-v": false, "--verbose": false,
+	"-i": false, "--include": false, "-g": false, "--globoff": false, "-f": false, "--fail": false,
+	"-O": false, "--remote-name": false, "-J": false, "--remote-header-name": false,
+	"--http1.0": false, "--http1.1": false, "--http2": false, "--http2-prior-knowledge": false,
+	"-o": true, "--output": true, "-m": true, "--max-time": true, "--connect-timeout": true,
+	"-w": true, "--write-out": true, "--retry": true, "-x": true, "--proxy": true,
+}
+
+// curl options that take a value, by their short names
+var curlShort = map[string]string{
+	"H": "--header", "b": "--cookie", "d": "--data", "X": "--request",
+	"A": "--user-agent", "e": "--referer", "u": "--user",
+}
+
+// headers that are set by the download itself or would break it, like
+// compression that is then not undone
+var copiedHeadersSkipped = map[string]bool{
+	"Host": true, "Content-Length": true, "Connection": true, "Accept-Encoding": true,
+	"Range": true, "If-Range": true, "If-Match": true, "If-None-Match": true,
+	"If-Modified-Since": true, "If-Unmodified-Since": true, "Cookie": true,
+	"Authority": true, // the http2 pseudo header, copied without the colon
+}
+
+// ParseCurl reads a command copied as cURL (bash) from the browser, giving
+// its url and the options to make a download with New
+func ParseCurl(command string) (string, Options, error) {
+	args, err := splitShell(command)
+	if err != nil {
+		return "", Options{}, err
+	}
+	return ParseCurlArgs(args)
+}
+
+// ParseCurlArgs is ParseCurl for an already split command line, with or
+// without the curl at the start
+func ParseCurlArgs(args []string) (string, Options, error) {
+	if len(args) > 0 && (args[0] == "curl" || strings.HasSuffix(args[0], "/curl") || strings.HasSuffix(args[0], "curl.exe")) {
+		args = args[1:]
+	}
+	opts := Options{Header: http.Header{}, Cookies: map[string]string{}}
+	var rawUrl string
+	var data []string
+	var get bool
+	for i := 0; i < len(args); i++ {
+		arg, value, hasValue := args[i], "", false
+		if strings.HasPrefix(arg, "--") {
+			if eq := strings.Index(arg, "="); eq > 0 {
+				arg, value, hasValue = arg[:eq], arg[eq+1:], true
+			}
+		} else if len(arg) > 2 && arg[0] == '-' {
+			if long, ok := curlShort[arg[1:2]]; ok { // value attached, like -XPOST
+				arg, value, hasValue = long, arg[2:], true
+			} else { // flags together, like -sSL
+				for _, flag := range arg[1:] {
+					if flag == 'G' {
+						get = true
+					} else if takesValue, ok := curlIgnored["-"+string(flag)]; !ok || takesValue {
+						return "", opts, fmt.Errorf("Unsupported curl option '-%c' in '%s'", flag, arg)
+					}
+				}
+				continue
+			}
+		} else if long, ok := curlShort[strings.TrimPrefix(arg, "-")]; ok && len(arg) == 2 {
+			arg = long
+		}
+		takesValue := false
+		switch arg {
+		case "--header", "--cookie", "--data", "--data-raw", "--data-binary", "--data-ascii", "--data-urlencode",
+			"--request", "--user-agent", "--referer", "--user", "--url":
+			takesValue = true
+		default:
+			takesValue = curlIgnored[arg]
+		}
+		if takesValue && !hasValue {
+			if i++; i == len(args) {
+				return "", opts, fmt.Errorf("No value for the curl option '%s'", arg)
+			}
+			value = args[i]
+		}
+		switch arg {
+		case "--url":
+			rawUrl = value
+		case "--header":
+			name, headerValue, err := splitHeader(value)
+			if err != nil {
+				return "", opts, err
+			}
+			addCopiedHeader(&opts, name, headerValue)
+		case "--cookie":
+			if !strings.Contains(value, "=") {
+				return "", opts, fmt.Errorf("Cookie files are not supported here, got '%s'", value)
+			}
+			addCookies(opts.Cookies, value)
+		case "--data", "--data-ascii", "--data-binary":
+			if strings.HasPrefix(value, "@") { // from a file
+				content, err := ioutil.ReadFile(value[1:])
+				if err != nil {
+					return "", opts, err
+				}
+				value = string(content)
+				if arg != "--data-binary" {
+					value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+				}
+			}
+			data = append(data, value)
+		case "--data-raw":
+			data = append(data, value)
+		case "--data-urlencode":
+			if eq := strings.Index(value, "="); eq >= 0 {
+				value = value[:eq+1] + url.QueryEscape(value[eq+1:])
+			} else {
+				value = url.QueryEscape(value)
+			}
+			data = append(data, value)
+		case "--request":
+			opts.Method = strings.ToUpper(value)
+		case "--user-agent":
+			opts.Header.Set("User-Agent", value)
+		case "--referer":
+			opts.Header.Set("Referer", value)
+		case "--user":
+			user := strings.SplitN(value, ":", 2)
+			opts.Credentials.User = user[0]
+			if len(user) > 1 {
+				opts.Credentials.Password = user[1]
+			}
+		case "-G", "--get":
+			get = true
+		case "-I", "--head":
+			return "", opts, fmt.Errorf("A HEAD request has nothing to download")
+		default:
+			if strings.HasPrefix(arg, "-") {
+				if _, ok := curlIgnored[arg]; !ok {
+					return "", opts, fmt.Errorf("Unsupported curl option '%s'", arg)
+				}
+			} else if rawUrl == "" {
+				rawUrl = arg
+			} else {
+				return "", opts, fmt.Errorf("Only one url is supported, got '%s' and '%s'", rawUrl, arg)
+			}
+		}
+	}
+	if rawUrl == "" {
+		return "", opts, fmt.Errorf("No url in the curl command")
+	}
+	if len(data) > 0 {
+		body := strings.Join(data, "&")
+		if get { // as the query
+			if strings.Contains(rawUrl, "?") {
+				rawUrl += "&" + body
+			} else {
+				rawUrl += "?" + body
+			}
+		} else {
+			opts.Body = body
+			if opts.Method == "" {
+				opts.Method = "POST"
+			}
+			if opts.Header.Get("Content-Type") == "" {
+				opts.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+		}
+	}
+	return checkCopied(rawUrl, opts)
+}
+
+// a HAR file, a single entry or just its request, as copied from the browser
+type harContent struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+	harEntry
+	harRequest
+}
+
+type harEntry struct {
+	Request *harRequest `json:"request"`
+}
+
+type harRequest struct {
+	Method   string    `json:"method"`
+	Url      string    `json:"url"`
+	Headers  []harPair `json:"headers"`
+	Cookies  []harPair `json:"cookies"`
+	PostData *struct {
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+	} `json:"postData"`
+}
+
+type harPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ParseHAR reads a request copied as HAR from the browser, as a HAR file
+// with a single entry, an entry or a request, giving its url and the options
+// to make a download with New
+func ParseHAR(content []byte) (string, Options, error) {
+	var har harContent
+	if err := json.Unmarshal(content, &har); err != nil {
+		return "", Options{}, fmt.Errorf("Bad HAR: %v", err)
+	}
+	request := &har.harRequest
+	if entries := har.Log.Entries; len(entries) > 1 {
+		return "", Options{}, fmt.Errorf("The HAR has %d entries, copy only the download's", len(entries))
+	} else if len(entries) == 1 && entries[0].Request != nil {
+		request = entries[0].Request
+	} else if har.Request != nil {
+		request = har.Request
+	}
+	opts := Options{Header: http.Header{}, Cookies: map[string]string{}}
+	if request.Method != "GET" {
+		opts.Method = strings.ToUpper(request.Method)
+	}
+	for _, header := range request.Headers {
+		addCopiedHeader(&opts, header.Name, header.Value)
+	}
+	for _, cookie := range request.Cookies {
+		opts.Cookies[cookie.Name] = cookie.Value
+	}
+	if request.PostData != nil && request.PostData.Text != "" {
+		opts.Body = request.PostData.Text
+		if opts.Header.Get("Content-Type") == "" && request.PostData.MimeType != "" {
+			opts.Header.Set("Content-Type", request.PostData.MimeType)
+		}
+	}
+	return checkCopied(request.Url, opts)
+}
+
+// add a copied header, taking the cookies out
+func addCopiedHeader(opts *Options, name, value string) {
+	name = http.CanonicalHeaderKey(name)
+	if name == "Cookie" {
+		addCookies(opts.Cookies, value)
+	} else if !copiedHeadersSkipped[name] && !strings.HasPrefix(name, ":") { // not http2 pseudo headers
+		opts.Header.Add(name, value)
+	}
+}
+
+// from a cookie header like "a=1; b=2"
+func addCookies(cookies map[string]string, header string) {
+	for _, pair := range strings.Split(header, ";") {
+		if parts := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(parts) == 2 && parts[0] != "" {
+			cookies[parts[0]] = parts[1]
+		}
+	}
+}
+
+func splitHeader(line string) (string, string, error) {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) < 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", "", fmt.Errorf("Header should be like 'Name: value', got '%s'", line)
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
+}
+
+func checkCopied(rawUrl string, opts Options) (string, Options, error) {
+	if parsed, err := url.Parse(rawUrl); err != nil {
+		return "", opts, err
+	} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", opts, fmt.Errorf("Not an http url: '%s'", rawUrl)
+	}
+	if opts.Method == "GET" {
+		opts.Method = ""
+	}
+	return rawUrl, opts, nil
+}
+
+// split a bash command line to its words, with the quotes as bash does them,
+// including $'...' with escapes as in the commands copied by browsers
+func splitShell(command string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		char := runes[i]
+		switch {
+		case char == '\\':
+			if i++; i == len(runes) {
+				return nil, fmt.Errorf("Command ends with a backslash")
+			} else if runes[i] != '\n' { // not a line continuation
+				word.WriteRune(runes[i])
+				inWord = true
+			}
+		case char == '\'': // as it is until the next one
+			end := i + 1
+			for end < len(runes) && runes[end] != '\'' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("Unterminated quote in the command")
+			}
+			word.WriteString(string(runes[i+1 : end]))
+			i = end
+			inWord = true
+		case char == '$' && i+1 < len(runes) && runes[i+1] == '\'':
+			value, length, err := unescapeAnsiC(runes[i+2:])
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(value)
+			i += length + 2
+			inWord = true
+		case char == '"':
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`\n", runes[i+1]) {
+					if i++; runes[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, fmt.Errorf("Unterminated quote in the command")
+			}
+			inWord = true
+		case char == ' ' || char == '\t' || char == '\n' || char == '\r':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(char)
+			inWord = true
+		}
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// the value of $'...' up to the closing quote, and the runes it took
+func unescapeAnsiC(runes []rune) (string, int, error) {
+	var value strings.Builder
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '\'' {
+			return value.String(), i + 1, nil
+		} else if runes[i] != '\\' || i+1 == len(runes) {
+			value.WriteRune(runes[i])
+			continue
+		}
+		i++
+		switch runes[i] {
+		case 'n':
+			value.WriteByte('\n')
+		case 't':
+			value.WriteByte('\t')
+		case 'r':
+			value.WriteByte('\r')
+		case 'x', 'u', 'U': // hex code
+			digits := map[rune]int{'x': 2, 'u': 4, 'U': 8}[runes[i]]
+			end := i + 1
+			for end < len(runes) && end < i+1+digits && strings.ContainsRune("0123456789abcdefABCDEF", runes[end]) {
+				end++
+			}
+			code, err := strconv.ParseUint(string(runes[i+1:end]), 16, 32)
+			if err != nil {
+				return "", 0, fmt.Errorf("Bad escape in the command: \\%s", string(runes[i:end]))
+			}
+			if runes[i] == 'x' {
+				value.WriteByte(byte(code))
+			} else {
+				value.WriteRune(rune(code))
+			}
+			i = end - 1
+		default: // \\, \', \" and the rest as they are
+			value.WriteRune(runes[i])
+		}
+	}
+	return "", 0, fmt.Errorf("Unterminated quote in the command")
+}
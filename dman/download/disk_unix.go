@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+// -{go fmt %f}
+
+package download
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// free space available to the user on the filesystem of the path
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// whether the paths are on the same filesystem, assumed if unknown
+func sameDevice(path1, path2 string) bool {
+	stat1, err1 := os.Stat(path1)
+	stat2, err2 := os.Stat(path2)
+	if err1 != nil || err2 != nil {
+		return true
+	}
+	sys1, ok1 := stat1.Sys().(*syscall.Stat_t)
+	sys2, ok2 := stat2.Sys().(*syscall.Stat_t)
+	if !ok1 || !ok2 {
+		return true
+	}
+	return sys1.Dev == sys2.Dev
+}
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,45 @@
+// -{go fmt %f}
+
+package download
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ERROR_HANDLE_DISK_FULL = syscall.Errno(39)
+	ERROR_DISK_FULL        = syscall.Errno(112)
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// free space available to the user on the volume of the path
+func freeSpace(path string) (int64, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&free)), 0, 0); ok == 0 {
+		return 0, err
+	}
+	return int64(free), nil
+}
+
+// whether the paths are on the same volume, assumed if unknown
+func sameDevice(path1, path2 string) bool {
+	abs1, err1 := filepath.Abs(path1)
+	abs2, err2 := filepath.Abs(path2)
+	if err1 != nil || err2 != nil {
+		return true
+	}
+	return strings.EqualFold(filepath.VolumeName(abs1), filepath.VolumeName(abs2))
+}
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, ERROR_DISK_FULL) || errors.Is(err, ERROR_HANDLE_DISK_FULL)
+}
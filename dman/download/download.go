@@ -4,6 +4,7 @@
 package download
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,6 +13,8 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,9 +25,12 @@ const (
 	LEN_CHECK      = 32 * KB // data interval to check if connection should stop
 	MIN_CUT_ETA    = 10      // minimum ramaining time to split connection, in seconds
 	STAT_INTERVAL  = 500 * time.Millisecond
+	MAX_REFRESHES  = 3                       // times a job can ask for a new url
 	LONG_TIME      = 3 * 24 * int(time.Hour) // 3 days, arbitrarily large duration
 	PART_DIR_NAME  = ".dman"
 	PROG_FILE_EXT  = ".dman"
+	LOCK_FILE_EXT  = ".lock" // beside the progress file, locked while downloading
+	PROG_FILE_SIZE = 8 * KB  // reserved to be able to save progress when the disk is full
 	MOVING_AVG_LEN = 5
 	// download states
 	S_DOWNLOADING = 0
@@ -37,16 +43,49 @@ var (
 	PausedError       = fmt.Errorf("paused")
 	NoSplitError      = fmt.Errorf("No job to split found")
 	NotResumableError = fmt.Errorf("Connection not resumable")
+	shortRebuildError = fmt.Errorf("Rebuilt file is shorter than expected")
+	DiskFullError     = fmt.Errorf("Disk full")
+	SkippedError      = fmt.Errorf("Identical file exists")
+	FileExistsError   = fmt.Errorf("File exists")
+	ChecksumError     = fmt.Errorf("Checksum mismatch")
+	ActiveError       = fmt.Errorf("The download is in progress")
 )
 
+// what to do when a file with the same name exists
+type Conflict string
+
+const (
+	CONFLICT_RENAME    Conflict = "rename"    // add a number to the name
+	CONFLICT_OVERWRITE Conflict = "overwrite" // replace the existing file
+	CONFLICT_SKIP      Conflict = "skip"      // don't download if identical, rename otherwise
+	CONFLICT_RESUME    Conflict = "resume"    // continue the existing file as a partial download
+	CONFLICT_FAIL      Conflict = "fail"
+)
+
+// for downloads without their own policy
+var DefaultConflict = CONFLICT_RENAME
+
 type Status struct {
-	Id         int     `json:"id,omitempty"`
-	Rebuilding bool    `json:"rebuilding,omitempty"`
-	Speed      string  `json:"speed,omitempty"`
-	Written    string  `json:"written,omitempty"`
-	Percent    float64 `json:"percent,omitempty"`
-	Conns      int     `json:"conns,omitempty"`
-	Eta        string  `json:"eta,omitempty"`
+	Id         int       `json:"id,omitempty"`
+	Rebuilding bool      `json:"rebuilding,omitempty"`
+	Extracting bool      `json:"extracting,omitempty"`
+	Speed      string    `json:"speed,omitempty"`
+	Written    string    `json:"written,omitempty"`
+	Percent    float64   `json:"percent,omitempty"` // -1 if the length is unknown
+	Conns      int       `json:"conns,omitempty"`
+	Eta        string    `json:"eta,omitempty"`
+	Limit      string    `json:"limit,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`    // written, for aggregating
+	Rate       int64     `json:"rate,omitempty"`     // speed in bytes per second
+	Segments   []Segment `json:"segments,omitempty"` // of the connections, the rest is done
+}
+
+// the part of the file a connection is downloading
+type Segment struct {
+	Offset   int64 `json:"offset"`
+	Length   int64 `json:"length"` // -1 if unknown
+	Received int64 `json:"received"`
 }
 
 func getFilename(resp *http.Response) string {
@@ -59,9 +98,22 @@ func getFilename(resp *http.Response) string {
 		url_parts := strings.Split(resp.Request.URL.Path, "/")
 		filename = url_parts[len(url_parts)-1]
 	}
+	if filename = CleanFilename(filename); filename == "" {
+		return "download"
+	}
 	return filename
 }
 
+// CleanFilename keeps only the last element of a name given by others, to
+// not write outside the dir, "" if it is not usable like . or ..
+func CleanFilename(name string) string {
+	name = filepath.Base(strings.TrimSpace(name))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return ""
+	}
+	return name
+}
+
 func ReadableSize(length int64) string {
 	var value = float64(length)
 	var unit string
@@ -87,6 +139,9 @@ type downJob struct {
 	file                                        *os.File
 	bufLenCh                                    chan int64
 	err                                         error
+	closed                                      bool // body and bufLenCh closed
+	stopping                                    bool // being wound down to reduce connections
+	refreshes                                   int  // times the url was refreshed for this
 }
 
 type checkJob struct {
@@ -95,38 +150,314 @@ type checkJob struct {
 }
 
 type Download struct {
+	// extraction progress, first for 64 bit alignment on 32 bit platforms
+	extractDone  int64
+	extractTotal int64
 	// Required:
-	Id       int
-	Url      string
-	Dir      string
-	maxConns int
-	Err      chan error
+	Id         int
+	Url        string
+	urlMutex   sync.Mutex
+	urlRefresh chan bool // closed when the ongoing refresh is done, nil if none
+	Dir        string
+	maxConns   int
+	connsMutex sync.Mutex
+	limiter    limiter
+	Err        chan error
 	// status
 	Status chan Status
 	// Dynamically set:
 	Filename  string
 	Length    int64
+	Resumable bool     // the server accepts ranges, can be split and paused
+	Conflict  Conflict // if the file exists, DefaultConflict if not set
+	// Optional, called when a range request is refused with an auth or
+	// expiry status, to get a fresh url and continue
+	ResolveUrl func(status int) (string, error)
+	// Optional, extra request headers
+	Header http.Header
+	// Optional, sent with every request, name: value
+	Cookies map[string]string
+	// Optional, gives the cookies for the requests and keeps those set by the
+	// responses, like a CookieJar loaded from cookies.txt
+	Jar http.CookieJar
+	// Optional, for the servers asking with 401, or looked up in .netrc if
+	// Netrc is set. AskCredentials is called for them when there are none or
+	// when they are refused, with the realm
+	Credentials    Credentials
+	Netrc          bool
+	AskCredentials func(realm string) (Credentials, error)
+	auth           authState
+	// Optional, the request method, GET if empty, and its body
+	Method string
+	Body   string
+	// Optional, to verify the file, like "sha-256=<hex>"
+	Checksum string
+	// Optional, not used here, only kept with the progress for the queue of
+	// the caller, higher first
+	Priority int
+	// Optional, extract archives when complete, into ExtractDir or beside
+	Extract    bool
+	ExtractDir string
+	// Optional, run in order after the file is complete
+	Hooks []Hook
+	// errors from the hooks, set when done
+	Warnings  []string
 	checkJob  chan checkJob
 	jobDone   chan *downJob
 	Jobs      map[int64]*downJob
 	jobsDone  []*downJob
 	insertJob chan [2]*downJob
+	pending   []*downJob // ranges left by wound down jobs, to be taken by others
+	changed   chan bool  // connections target changed
+	lock      *os.File   // held while downloading
+	replaces  string     // the existing file to replace when complete, to overwrite
 	Stop      chan os.Signal
+	stopMutex sync.Mutex
+	ended     bool // Stop is closed
+}
+
+// SetMaxConns changes the target number of connections, even while downloading
+func (down *Download) SetMaxConns(maxConns int) {
+	if maxConns < 1 {
+		maxConns = 1
+	}
+	down.connsMutex.Lock()
+	down.maxConns = maxConns
+	down.connsMutex.Unlock()
+	select {
+	case down.changed <- true:
+	default: // already notified
+	}
+}
+
+// Pause asks the download to stop, keeping what is downloaded if resumable.
+// unlike sending on Stop, it can be called even after the download ended
+func (down *Download) Pause() {
+	down.stopMutex.Lock()
+	defer down.stopMutex.Unlock()
+	if down.ended {
+		return
+	}
+	select {
+	case down.Stop <- os.Interrupt:
+	default: // already asked
+	}
+}
+
+func (down *Download) MaxConns() int {
+	down.connsMutex.Lock()
+	defer down.connsMutex.Unlock()
+	return down.maxConns
+}
+
+// Options are the optional settings of a download, saved with the progress
+// to be kept when resumed. the credentials, cookies and secretHeaders are
+// left out of it, to be given again
+type Options struct {
+	Filename string            `json:"-"` // instead of the one from the server, saved anyway
+	Header   http.Header       `json:"header,omitempty"`
+	Cookies  map[string]string `json:"-"`
+	Method   string            `json:"method,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Checksum string            `json:"checksum,omitempty"`
+	Limit    int64             `json:"limit,omitempty"` // bytes per second
+	Priority int               `json:"priority,omitempty"`
+	Conflict Conflict          `json:"conflict,omitempty"`
+	// asked for when resuming if not given again
+	Credentials Credentials `json:"-"`
+}
+
+// request headers with credentials
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// Options gives a copy of the current options
+func (down *Download) Options() Options {
+	var cookies map[string]string
+	if down.Cookies != nil {
+		cookies = map[string]string{}
+		for name, value := range down.Cookies {
+			cookies[name] = value
+		}
+	}
+	return Options{
+		Filename:    down.Filename,
+		Header:      down.Header.Clone(),
+		Cookies:     cookies,
+		Method:      down.Method,
+		Body:        down.Body,
+		Checksum:    down.Checksum,
+		Limit:       down.Limit(),
+		Priority:    down.Priority,
+		Conflict:    down.Conflict,
+		Credentials: down.Credentials,
+	}
+}
+
+// SetOptions applies the options that are set, the others are kept
+func (down *Download) SetOptions(opts Options) {
+	if opts.Filename != "" {
+		down.Filename = opts.Filename
+	}
+	if len(opts.Header) > 0 && down.Header == nil {
+		down.Header = http.Header{}
+	}
+	for name, values := range opts.Header {
+		down.Header[name] = values
+	}
+	if len(opts.Cookies) > 0 && down.Cookies == nil {
+		down.Cookies = map[string]string{}
+	}
+	for name, value := range opts.Cookies {
+		down.Cookies[name] = value
+	}
+	if opts.Method != "" {
+		down.Method = opts.Method
+	}
+	if opts.Body != "" {
+		down.Body = opts.Body
+	}
+	if opts.Checksum != "" {
+		down.Checksum = opts.Checksum
+	}
+	if opts.Limit > 0 {
+		down.SetLimit(opts.Limit)
+	}
+	if opts.Priority != 0 {
+		down.Priority = opts.Priority
+	}
+	if opts.Credentials != (Credentials{}) {
+		down.Credentials = opts.Credentials
+	}
+	if opts.Conflict != "" {
+		down.Conflict = opts.Conflict
+	}
+}
+
+// SetLimit changes the speed limit in bytes per second, 0 for unlimited
+func (down *Download) SetLimit(limit int64) {
+	down.limiter.setRate(limit)
+}
+
+func (down *Download) Limit() int64 {
+	return down.limiter.getRate()
+}
+
+// the url, which can be refreshed while downloading
+func (down *Download) CurrentUrl() string {
+	down.urlMutex.Lock()
+	defer down.urlMutex.Unlock()
+	return down.Url
+}
+
+// whether the status may mean the url has expired or lost its authorization
+func expiredStatus(status int) bool {
+	return status == 401 || status == 403 || status == 410
+}
+
+// get a new url from ResolveUrl, returns whether it can be retried. only
+// one job asks, the others wait for it, without holding the lock
+func (down *Download) refreshUrl(failedUrl string, status int) bool {
+	if down.ResolveUrl == nil {
+		return false
+	}
+	down.urlMutex.Lock()
+	if down.Url != failedUrl { // already refreshed for another job
+		down.urlMutex.Unlock()
+		return true
+	} else if waiting := down.urlRefresh; waiting != nil {
+		down.urlMutex.Unlock()
+		<-waiting
+		return down.CurrentUrl() != failedUrl
+	}
+	done := make(chan bool)
+	down.urlRefresh = done
+	down.urlMutex.Unlock()
+	url, err := down.ResolveUrl(status)
+	down.urlMutex.Lock()
+	if err == nil && url != "" && down.Url == failedUrl {
+		down.Url = url
+	}
+	refreshed := down.Url != failedUrl
+	down.urlRefresh = nil
+	down.urlMutex.Unlock()
+	close(done)
+	return refreshed
+}
+
+// make a request for the url, with a range if given, answering the
+// authentication challenges
+func (down *Download) request(url, byteRange string) (*http.Response, error) {
+	method := down.Method
+	if method == "" {
+		method = "GET"
+	}
+	client := &http.Client{
+		Jar: down.Jar, // also for the redirects
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			// kept by go for the same domain, but made for the previous url
+			req.Header.Del("Authorization")
+			down.authorize(req)
+			return nil
+		},
+	}
+	for tries := 0; ; tries++ {
+		var body io.Reader
+		if down.Body != "" {
+			body = strings.NewReader(down.Body)
+		}
+		req, err := http.NewRequest(method, url, body)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range down.Header {
+			req.Header[name] = values
+		}
+		for name, value := range down.Cookies {
+			req.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+		if byteRange != "" {
+			req.Header.Set("Range", "bytes="+byteRange)
+		}
+		generation := down.authorize(req)
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode != 401 || tries == MAX_AUTH_TRIES || !down.answerChallenge(resp, generation) {
+			return resp, err
+		}
+		resp.Body.Close()
+	}
+}
+
+// check if the server accepts range requests, for those that don't say it
+func (down *Download) probeRanges() bool {
+	resp, err := down.request(down.CurrentUrl(), "0-0")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == 206
 }
 
 func (down *Download) getResponse(job *downJob) *http.Response {
-	req, _ := http.NewRequest("GET", down.Url, nil)
+	var byteRange string
 	if job.length > 0 { // unknown length, probably additional connection
 		// request partial content
-		req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", job.offset+job.received, job.offset+job.length-1))
+		byteRange = fmt.Sprintf("%d-%d", job.offset+job.received, job.offset+job.length-1)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	url := down.CurrentUrl()
+	resp, err := down.request(url, byteRange)
 	if err != nil {
 		job.err = err
 		return nil
 	} else if job.length > 0 { // resuming
 		if resp.StatusCode != 206 { // partial content requested
 			resp.Body.Close()
+			if expiredStatus(resp.StatusCode) && job.refreshes < MAX_REFRESHES && down.refreshUrl(url, resp.StatusCode) {
+				job.refreshes++
+				return down.getResponse(job)
+			}
 			if resp.StatusCode == 200 {
 				job.err = NotResumableError
 			} else {
@@ -185,23 +516,40 @@ func (down *Download) updateStatus() func(int64) {
 		avgSpeed = (avgSpeed + speed) / int64(len(speedHist))
 		// average eta from average speed
 		var eta string
-		if avgSpeed == 0 {
+		if down.Length < 0 {
+			eta = "Unknown"
+		} else if avgSpeed == 0 {
 			eta = "LongTime"
 		} else {
 			etaVal := (down.Length - written) * int64(time.Second) / avgSpeed
 			eta = time.Duration(etaVal).Round(time.Second).String()
 		}
-		var percent float64
+		percent := float64(-1) // unknown
 		if down.Length > 0 {
 			percent = float64(written) / float64(down.Length) * 100
+		} else if down.Length == 0 {
+			percent = 100
+		}
+		var limit string
+		if lim := down.Limit(); lim > 0 {
+			limit = ReadableSize(lim) + "/s"
+		}
+		var segments []Segment
+		for _, job := range down.jobList() {
+			segments = append(segments, Segment{Offset: job.offset, Length: job.length, Received: job.received})
 		}
 		down.Status <- Status{
-			Id:      down.Id,
-			Speed:   ReadableSize(avgSpeed) + "/s",
-			Percent: percent,
-			Written: ReadableSize(written),
-			Conns:   len(down.Jobs),
-			Eta:     eta,
+			Id:       down.Id,
+			Speed:    ReadableSize(avgSpeed) + "/s",
+			Percent:  percent,
+			Written:  ReadableSize(written),
+			Conns:    len(down.Jobs),
+			Eta:      eta,
+			Limit:    limit,
+			Filename: down.Filename,
+			Bytes:    written,
+			Rate:     avgSpeed,
+			Segments: segments,
 		}
 	}
 }
@@ -210,13 +558,16 @@ func (down *Download) addJob() error {
 	var longest *downJob // connection having the longest undownloaded part
 	var longestFree int64
 	for _, job := range down.Jobs {
+		if job.closed {
+			continue
+		}
 		free := job.length - job.received // not yet downloaded
 		if free > longestFree {
 			longest = down.Jobs[job.offset]
 			longestFree = free
 		}
 	}
-	if longest == nil || longest.eta < MIN_CUT_ETA {
+	if !down.Resumable || longest == nil || longest.eta < MIN_CUT_ETA {
 		return NoSplitError
 	}
 	newLen := longestFree / 2
@@ -231,6 +582,102 @@ func (down *Download) addJob() error {
 	return nil
 }
 
+// start a job for a pending range if any, or split one
+func (down *Download) nextJob() bool {
+	if len(down.pending) == 0 {
+		return down.addJob() == nil
+	}
+	job := down.pending[0]
+	down.pending = down.pending[1:]
+	go func() {
+		down.getResponse(job)
+		down.insertJob <- [2]*downJob{job, nil}
+	}()
+	return true
+}
+
+// give up a job that was being added
+func (down *Download) dropJob(jobs [2]*downJob) {
+	job, longest := jobs[0], jobs[1]
+	if job.body != nil {
+		job.body.Close()
+		job.body = nil
+	}
+	if longest == nil { // pending range, keep for later
+		job.err = nil
+		down.pending = append(down.pending, job)
+	}
+}
+
+// stop the job's download goroutine
+func (down *Download) closeJob(job *downJob) {
+	if job.closed {
+		return
+	}
+	job.body.Close()
+	close(job.bufLenCh)
+	job.closed = true
+}
+
+// wind down the jobs furthest from done if there are more than the target
+func (down *Download) reduceJobs() {
+	var running int
+	for _, job := range down.Jobs {
+		if !job.closed {
+			running++
+		}
+	}
+	for excess := running - down.MaxConns(); excess > 0; excess-- {
+		var furthest *downJob
+		for _, job := range down.Jobs {
+			if job.closed || job.length <= 0 { // unknown length cannot be cut
+				continue
+			}
+			if furthest == nil || job.length-job.received > furthest.length-furthest.received {
+				furthest = job
+			}
+		}
+		if furthest == nil {
+			return
+		}
+		furthest.stopping = true
+		down.closeJob(furthest)
+	}
+}
+
+// cut a wound down job at what it received, the rest becomes pending.
+// returns whether the job has something to keep
+func (down *Download) releaseJob(job *downJob) bool {
+	job.err = nil
+	stat, err := job.file.Stat()
+	if err != nil {
+		job.err = err
+		return true
+	}
+	received := stat.Size() // more reliable than the count, checks may still be queued
+	if received >= job.length {
+		job.received = job.length
+		return true
+	}
+	if received == 0 { // nothing to keep, retry as a whole
+		down.pending = append(down.pending, job)
+		return false
+	}
+	rest := &downJob{
+		offset: job.offset + received,
+		length: job.length - received,
+	}
+	file, err := os.Create(down.jobFileName(rest.offset))
+	if err != nil {
+		job.err = err
+		return true
+	}
+	rest.file = file
+	job.received, job.length = received, received
+	down.pending = append(down.pending, rest)
+	return true
+}
+
 func (down *Download) initJob(job *downJob) {
 	// to receive buffer length from down.coordinate()
 	job.bufLenCh = make(chan int64, 1)
@@ -250,8 +697,9 @@ func (down *Download) download(job *downJob) {
 	}
 	// kicksart the communication
 	down.checkJob <- checkJob{0, job}
+	body := limitedReader{job.body, &down.limiter}
 	for bufLen := range job.bufLenCh {
-		written, err := io.CopyN(job.file, job.body, bufLen)
+		written, err := io.CopyN(job.file, body, bufLen)
 		down.checkJob <- checkJob{written, job}
 		if err != nil {
 			job.err = err
@@ -266,93 +714,185 @@ func (down *Download) coordinate() {
 	defer close(down.insertJob)
 	defer close(down.jobDone)
 	defer close(down.Err)
-	defer close(down.Stop)
+	defer func() {
+		down.stopMutex.Lock()
+		down.ended = true
+		close(down.Stop)
+		down.stopMutex.Unlock()
+	}()
 	defer close(down.checkJob)
 	lastTime := time.Now()
 	timer := time.NewTimer(STAT_INTERVAL)
 	updateStat := down.updateStatus()
 	var mainError error
-	var addingJobLock bool
+	var addingJobLock, diskFull bool
 	state := S_DOWNLOADING
-	if down.maxConns > 1 {
+	if down.MaxConns() > 1 {
 		// add other conns
 		addingJobLock = down.addJob() == nil
 	}
+	// when no job is running, returns whether the download ended
+	settle := func(lastErr error) bool {
+		if state == S_DOWNLOADING && mainError == nil && lastErr == nil {
+			if !addingJobLock {
+				addingJobLock = down.nextJob()
+			}
+			if addingJobLock { // remaining ranges on the way
+				return false
+			}
+			// check the parts before rebuilding
+			if down.Length < 0 { // length was unknown, now known
+				down.Length = down.jobsDone[0].length
+			}
+			if broken, err := down.checkParts(); err != nil {
+				lastErr = err
+			} else if broken { // download them again
+				addingJobLock = down.nextJob()
+				return false
+			}
+		}
+		if addingJobLock {
+			// flush the new one
+			down.dropJob(<-down.insertJob)
+			addingJobLock = false
+		}
+		if state == S_STOPPING && diskFull {
+			mainError = DiskFullError
+		} else if state == S_STOPPING {
+			mainError = PausedError
+		} else if state != S_FAILING && lastErr != nil && mainError == nil {
+			// no previous errors, record this one
+			mainError = lastErr
+		}
+		if mainError != nil { // finished pausing or failing
+			down.jobsDone = append(down.jobsDone, down.pending...)
+			down.pending = nil
+			// close the completed files
+			for _, job := range down.jobsDone {
+				if stat, err := job.file.Stat(); err == nil { // checks may still be queued
+					job.received = stat.Size()
+					if job.length >= 0 && job.received > job.length {
+						job.received = job.length
+					}
+				}
+				if err := job.file.Close(); err != nil {
+					mainError = fmt.Errorf("%v, & %v", mainError, err)
+				}
+			}
+			down.saveProgress()
+			down.unlockProgress()
+			down.Err <- mainError
+			return true
+		}
+		// finished downloading, start rebuilding
+		state = S_REBUILDING
+		down.rebuild()
+		return false
+	}
+	if len(down.Jobs) == 0 && settle(nil) { // resumed with all parts done
+		return
+	}
 	for {
 		select {
 		case check := <-down.checkJob:
+			if check.job.stopping {
+				// received is taken from the file when done
+				continue
+			}
 			check.job.received += check.received
-			if state != S_DOWNLOADING {
+			if state != S_DOWNLOADING || check.job.closed {
 				// clean up already completed
 				continue
 			}
-			if check.job.received < check.job.length {
+			if check.job.length < 0 { // unknown length, until the end
+				check.job.bufLenCh <- LEN_CHECK
+			} else if check.job.received < check.job.length {
 				bufLen := int64(LEN_CHECK)
 				if remaining := check.job.length - check.job.received; remaining < bufLen {
 					bufLen = remaining
 				}
 				check.job.bufLenCh <- bufLen
 			} else { // clean up
-				check.job.body.Close()
-				close(check.job.bufLenCh)
+				down.closeJob(check.job)
 			}
 		case job := <-down.jobDone:
 			if job.offset < 0 { // finished rebuilding
+				if isDiskFull(job.err) { // keep what is rebuilt as the first part
+					down.keepRebuilt(job.received)
+					down.saveProgress()
+					down.unlockProgress()
+					down.Err <- DiskFullError
+					return
+				}
+				if job.err == shortRebuildError { // download the missing end again
+					first := down.jobsDone[0]
+					first.received, first.length = job.received, down.Length
+					down.jobsDone = nil
+					down.pending = append(down.pending, first)
+					state = S_DOWNLOADING
+					addingJobLock = down.nextJob()
+					continue
+				}
+				down.unlockProgress()
 				down.Err <- job.err
 				return
 			}
 			delete(down.Jobs, job.offset)
-			down.jobsDone = append(down.jobsDone, job)
+			if isDiskFull(job.err) { // pause to keep what is written
+				job.err = nil
+				if state == S_DOWNLOADING {
+					state = S_STOPPING
+					diskFull = true
+					for _, job := range down.Jobs {
+						down.closeJob(job)
+					}
+				}
+			}
+			if job.length < 0 && job.err == io.EOF { // unknown length, reached the end
+				job.err = nil
+				if stat, err := job.file.Stat(); err == nil {
+					job.length = stat.Size()
+				} else {
+					job.err = err
+				}
+			}
+			if !job.stopping || down.releaseJob(job) {
+				down.jobsDone = append(down.jobsDone, job)
+			}
 			failed := job.err != nil && state == S_DOWNLOADING
 			if failed {
 				mainError = job.err
 			}
 			if len(down.Jobs) == 0 {
-				if addingJobLock {
-					// flush the new one
-					jobs := <-down.insertJob
-					jobs[0].body.Close()
-				}
-				if state == S_STOPPING {
-					mainError = PausedError
-				} else if state != S_FAILING && job.err != nil && mainError == nil {
-					// no previous errors, record this one
-					mainError = job.err
-				}
-				if mainError != nil { // finished pausing or failing
-					// close the completed files
-					for _, job := range down.jobsDone {
-						if err := job.file.Close(); err != nil {
-							mainError = fmt.Errorf("%v, & %v", mainError, err)
-						}
-					}
-					down.saveProgress()
-					down.Err <- mainError
+				if settle(job.err) {
 					return
 				}
-				// finished downloading, start rebuilding
-				if down.Length < 0 { // length was unknown, now known
-					down.Length = job.length
-				}
-				state = S_REBUILDING
-				down.rebuild()
 			} else if failed { // failed
 				state = S_FAILING
 				for _, job := range down.Jobs { // start pausing others
-					job.body.Close()
-					close(job.bufLenCh)
+					down.closeJob(job)
 				}
-			} else if state == S_DOWNLOADING && !addingJobLock && len(down.Jobs) < down.maxConns {
-				addingJobLock = down.addJob() == nil
+			} else if state == S_DOWNLOADING && !addingJobLock && len(down.Jobs) < down.MaxConns() {
+				addingJobLock = down.nextJob()
 			}
 		case now := <-timer.C: // status update time
 			duration := int64(now.Sub(lastTime))
 			lastTime = now
 			if state == S_REBUILDING {
+				timer.Reset(STAT_INTERVAL)
+				if total := atomic.LoadInt64(&down.extractTotal); total > 0 {
+					if down.Status != nil && len(down.Status) == 0 {
+						down.Status <- Status{
+							Id:         down.Id,
+							Extracting: true,
+							Percent:    float64(atomic.LoadInt64(&down.extractDone)) / float64(total) * 100,
+						}
+					}
+					continue
+				}
 				stat, err := down.jobsDone[0].file.Stat()
-				if err != nil {
-					down.Err <- nil // maybe rebuilding finished already
-					return
+				if err != nil { // maybe rebuilding finished already
+					continue
 				}
 				if down.Status != nil && len(down.Status) == 0 {
 					down.Status <- Status{
@@ -366,68 +906,340 @@ func (down *Download) coordinate() {
 			updateStat(duration)
 			timer.Reset(STAT_INTERVAL)
 		case jobs := <-down.insertJob:
+			addingJobLock = false
 			job, longest := jobs[0], jobs[1]
-			if state != S_DOWNLOADING {
-				job.body.Close()
-				continue
-			}
-			if job.err == nil {
-				if longest.received < longest.length-job.length { // still in progress
-					file, err := os.Create(down.jobFileName(job.offset))
-					if err == nil {
-						job.file = file
-						down.initJob(job)
-						go down.download(job)
-						// add this job to the collection
-						down.Jobs[job.offset] = job
-						// subtract length from the helped job
-						longest.length -= job.length
-					} else {
-						job.body.Close()
-					}
+			err := job.err
+			if state != S_DOWNLOADING || err != nil {
+				down.dropJob(jobs)
+			} else if longest == nil { // pending range, file already there
+				job.closed, job.stopping = false, false
+				down.initJob(job)
+				go down.download(job)
+				down.Jobs[job.offset] = job
+			} else if longest.received < longest.length-job.length && !longest.closed { // still in progress
+				file, err := os.Create(down.jobFileName(job.offset))
+				if err == nil {
+					job.file = file
+					down.initJob(job)
+					go down.download(job)
+					// add this job to the collection
+					down.Jobs[job.offset] = job
+					// subtract length from the helped job
+					longest.length -= job.length
 				} else {
 					job.body.Close()
 				}
-			}
-			if len(down.Jobs) < down.maxConns {
-				addingJobLock = down.addJob() == nil
 			} else {
-				addingJobLock = false
+				job.body.Close()
+			}
+			if len(down.Jobs) == 0 {
+				if settle(err) {
+					return
+				}
+			} else if state == S_DOWNLOADING && err == nil {
+				down.reduceJobs() // target may have changed meanwhile
+				if len(down.Jobs) < down.MaxConns() {
+					addingJobLock = down.nextJob()
+				}
+			}
+		case <-down.changed:
+			if state != S_DOWNLOADING {
+				continue
+			}
+			down.reduceJobs()
+			if !addingJobLock && len(down.Jobs) < down.MaxConns() {
+				addingJobLock = down.nextJob()
 			}
 		case <-down.Stop:
 			if state == S_DOWNLOADING {
 				state = S_STOPPING
 				for _, job := range down.Jobs { // start pausing
-					job.body.Close()
-					close(job.bufLenCh)
+					down.closeJob(job)
 				}
 			}
 		}
 	}
 }
 
+// set the file info from the first response
+func (down *Download) inspect(resp *http.Response, firstJob *downJob) {
+	if down.Filename == "" { // may be given
+		down.Filename = getFilename(resp)
+	}
+	switch {
+	case firstJob.length < 0: // unknown length, single stream
+		down.Resumable = false
+	case resp.Header.Get("Accept-Ranges") == "bytes":
+		down.Resumable = true
+	case resp.Header.Get("Accept-Ranges") == "none":
+		down.Resumable = false
+	default: // not told, ask
+		down.Resumable = down.probeRanges()
+	}
+	down.Length = firstJob.length
+}
+
+// Probe gets the Filename, Length and Resumable without downloading
+func (down *Download) Probe() error {
+	firstJob := &downJob{}
+	resp := down.getResponse(firstJob)
+	if firstJob.err != nil {
+		return firstJob.err
+	}
+	resp.Body.Close()
+	down.inspect(resp, firstJob)
+	return nil
+}
+
 func (down *Download) Start() error {
+	if down.Checksum != "" { // fail early
+		if _, _, err := parseChecksum(down.Checksum); err != nil {
+			return err
+		}
+	}
 	firstJob := &downJob{}
 	resp := down.getResponse(firstJob)
 	if firstJob.err != nil {
 		return firstJob.err
 	}
-	// get filename
-	down.Filename = getFilename(resp)
+	down.inspect(resp, firstJob)
 	os.Mkdir(filepath.Join(down.Dir, PART_DIR_NAME), 666)
-	file, err := os.Create(down.jobFileName(0))
+	existing, err := down.resolveName()
 	if err != nil {
+		resp.Body.Close()
 		return err
 	}
-	firstJob.file = file
+	finalPath := filepath.Join(down.Dir, down.Filename)
+	if existing > 0 { // continue the existing file
+		resp.Body.Close()
+		if err := moveFile(finalPath, down.jobFileName(0)); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(down.jobFileName(0), os.O_RDWR, 666)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekEnd)
+		}
+		if err != nil {
+			moveFile(down.jobFileName(0), finalPath)
+			return err
+		}
+		firstJob = &downJob{length: down.Length, received: existing, file: file}
+		if down.getResponse(firstJob); firstJob.err != nil {
+			file.Close()
+			moveFile(down.jobFileName(0), finalPath)
+			return firstJob.err
+		}
+		if placeholder, err := os.Create(finalPath); err == nil { // keep it reserved
+			placeholder.Close()
+		}
+	}
+	if down.Length > 0 {
+		var overhead int64
+		if down.Resumable && down.MaxConns() > 1 { // parts after the first are at most half
+			overhead = down.Length / 2
+		}
+		if err := down.checkSpace(down.Length-existing, overhead); err != nil {
+			firstJob.body.Close()
+			down.unreserve(firstJob.file)
+			return err
+		}
+	}
+	if firstJob.file == nil {
+		file, err := os.Create(down.jobFileName(0))
+		if err != nil {
+			resp.Body.Close()
+			down.unreserve(nil)
+			return err
+		}
+		firstJob.file = file
+	}
 	down.initJob(firstJob)
-	down.Length = firstJob.length
 	down.Jobs[0] = firstJob
+	if err := down.lockProgress(down.ProgressFile()); err != nil {
+		firstJob.body.Close()
+		down.unreserve(firstJob.file)
+		return err
+	}
+	if err := down.saveProgress(); err != nil { // reserve the space for it
+		firstJob.body.Close()
+		down.unreserve(firstJob.file)
+		return err
+	}
 	go down.download(firstJob)
 	go down.coordinate()
 	return nil
 }
 
+// undo what Start did for a download that will not start
+func (down *Download) unreserve(file *os.File) {
+	finalPath := filepath.Join(down.Dir, down.Filename)
+	if file != nil {
+		file.Close()
+		if stat, err := os.Stat(file.Name()); err == nil && stat.Size() > 0 { // resumed existing
+			moveFile(file.Name(), finalPath)
+		} else {
+			os.Remove(file.Name())
+		}
+	}
+	if stat, err := os.Stat(finalPath); err == nil && stat.Size() == 0 { // placeholder
+		os.Remove(finalPath)
+	}
+	os.Remove(down.ProgressFile())
+	down.unlockProgress()
+	os.Remove(filepath.Join(down.Dir, PART_DIR_NAME)) // only if empty
+}
+
+// decide the final name by the conflict policy and reserve it with an empty
+// file. returns the size of the existing file to continue, for CONFLICT_RESUME
+func (down *Download) resolveName() (int64, error) {
+	policy := down.Conflict
+	if policy == "" {
+		policy = DefaultConflict
+	}
+	path := filepath.Join(down.Dir, down.Filename)
+	if stat, err := os.Stat(path); err == nil { // the name exists
+		size := stat.Size()
+		switch policy {
+		case CONFLICT_OVERWRITE:
+			// downloaded under a reserved name, replacing it only when
+			// complete. an empty one is reserved by another download
+			if size > 0 {
+				replaces := down.Filename
+				if _, err := down.reserveFilename(); err != nil {
+					return 0, err
+				}
+				down.replaces = replaces
+				return 0, nil
+			}
+		case CONFLICT_FAIL:
+			return 0, FileExistsError
+		case CONFLICT_SKIP:
+			if down.identical(size) {
+				return 0, SkippedError
+			}
+		case CONFLICT_RESUME:
+			if down.identical(size) {
+				return 0, SkippedError // already complete
+			} else if down.Resumable && size > 0 && size < down.Length {
+				return size, nil
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	return down.reserveFilename()
+}
+
+func (down *Download) reserveFilename() (int64, error) {
+	name, err := reserveName(down.Dir, down.Filename)
+	if err != nil {
+		return 0, err
+	}
+	down.Filename = name
+	return 0, nil
+}
+
+// whether the existing file of the size is the one to download, by the size
+// and by Checksum if given
+func (down *Download) identical(size int64) bool {
+	return size > 0 && size == down.Length && down.verifyChecksum() == nil
+}
+
+// reserve a free name in dir with an empty file, adding " (n)" if it exists
+func reserveName(dir, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := name[:len(name)-len(ext)]
+	for i := 1; ; i++ {
+		placeholder, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil { // free, now reserved
+			placeholder.Close()
+			return name, nil
+		} else if !os.IsExist(err) {
+			return "", err
+		}
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+// check that there is enough free space to download the remaining and to
+// rebuild, with the overhead of copying a part before it's removed
+func (down *Download) checkSpace(remaining, overhead int64) error {
+	partDir := filepath.Join(down.Dir, PART_DIR_NAME)
+	if sameDevice(down.Dir, partDir) {
+		return enoughSpace(down.Dir, remaining+overhead)
+	}
+	if err := enoughSpace(partDir, remaining+overhead); err != nil {
+		return err
+	}
+	return enoughSpace(down.Dir, down.Length) // moved by copying
+}
+
+func enoughSpace(dir string, needed int64) error {
+	free, err := freeSpace(dir)
+	if err != nil { // unknown, don't stop for it
+		return nil
+	}
+	if free < needed {
+		return fmt.Errorf("Not enough space in '%s': %s needed, %s free", dir, ReadableSize(needed), ReadableSize(free))
+	}
+	return nil
+}
+
+// check that the parts have their full lengths and cover the whole file.
+// the broken ranges are queued to be downloaded again, returns whether any
+func (down *Download) checkParts() (bool, error) {
+	sort.Slice(down.jobsDone, func(i, j int) bool {
+		return down.jobsDone[i].offset < down.jobsDone[j].offset
+	})
+	var good []*downJob
+	var end int64 // where the next part should start
+	addGap := func(length int64) error {
+		file, err := os.Create(down.jobFileName(end))
+		if err != nil {
+			return err
+		}
+		down.pending = append(down.pending, &downJob{offset: end, length: length, file: file})
+		return nil
+	}
+	for _, job := range down.jobsDone {
+		if job.offset < end {
+			return false, fmt.Errorf("Parts overlap at %d", job.offset)
+		} else if job.offset > end { // missing range
+			if err := addGap(job.offset - end); err != nil {
+				return false, err
+			}
+		}
+		end = job.offset + job.length
+		stat, err := job.file.Stat()
+		if err != nil {
+			return false, err
+		}
+		if size := stat.Size(); size > job.length {
+			if err := job.file.Truncate(job.length); err != nil {
+				return false, err
+			}
+			if _, err := job.file.Seek(0, io.SeekEnd); err != nil {
+				return false, err
+			}
+		} else if size < job.length { // continue from where it is
+			if _, err := job.file.Seek(0, io.SeekEnd); err != nil {
+				return false, err
+			}
+			job.received = size
+			down.pending = append(down.pending, job)
+			continue
+		}
+		good = append(good, job)
+	}
+	if end < down.Length {
+		if err := addGap(down.Length - end); err != nil {
+			return false, err
+		}
+	}
+	down.jobsDone = good
+	return len(down.pending) > 0, nil
+}
+
 func (down *Download) rebuild() {
 	// sort by offset
 	sort.Slice(down.jobsDone, func(i, j int) bool {
@@ -435,18 +1247,24 @@ func (down *Download) rebuild() {
 	})
 	go func() {
 		var err error
+		done := &downJob{offset: -1}
 		defer func() {
-			down.jobDone <- &downJob{offset: -1, err: err}
+			done.err = err
+			down.jobDone <- done
 		}()
 		file := down.jobsDone[0].file
 		if down.Length < 0 { // unknown file size, single connection, length set at end
 			down.Length = down.jobsDone[0].length
 		}
 		for _, job := range down.jobsDone[1:] {
+			done.received = job.offset // rebuilt until here
 			if _, err = job.file.Seek(0, 0); err != nil {
 				return
 			}
 			if _, err = io.Copy(file, job.file); err != nil {
+				if isDiskFull(err) { // remove the incomplete copy
+					file.Truncate(job.offset)
+				}
 				return
 			}
 			if err = job.file.Close(); err != nil {
@@ -456,60 +1274,169 @@ func (down *Download) rebuild() {
 				return
 			}
 		}
-		if err = file.Close(); err != nil {
+		// check the final size
+		stat, err := file.Stat()
+		if err != nil {
 			return
 		}
-		// add number if another file with same name exists
-		if _, err := os.Stat(filepath.Join(down.Dir, down.Filename)); !os.IsNotExist(err) {
-			ext := filepath.Ext(down.Filename)
-			base := string(down.Filename[:len(down.Filename)-len(ext)])
-			for i := 1; ; i++ {
-				newName := fmt.Sprintf("%s (%d)%s", base, i, ext)
-				if _, err := os.Stat(filepath.Join(down.Dir, newName)); os.IsNotExist(err) {
-					down.Filename = newName
-					break
-				}
+		done.received = down.Length
+		if size := stat.Size(); size > down.Length {
+			if err = file.Truncate(down.Length); err != nil {
+				return
 			}
+		} else if size < down.Length {
+			err = shortRebuildError
+			done.received = size
+			return
 		}
-		if err = os.Rename(file.Name(), filepath.Join(down.Dir, down.Filename)); err != nil {
+		if err = file.Close(); err != nil {
+			return
+		}
+		// the name was reserved at start
+		if err = moveFile(file.Name(), filepath.Join(down.Dir, down.Filename)); err != nil {
 			return
 		}
+		os.Remove(down.ProgressFile())
 		os.Remove(filepath.Dir(file.Name())) // only if empty
+		if err = down.verifyChecksum(); err != nil {
+			return
+		}
+		if down.replaces != "" { // complete and verified, the existing one can go
+			if err = moveFile(filepath.Join(down.Dir, down.Filename), filepath.Join(down.Dir, down.replaces)); err != nil {
+				return
+			}
+			down.Filename, down.replaces = down.replaces, ""
+		}
+		if down.Extract {
+			if err := down.extract(); err != nil { // the download is still fine
+				down.Warnings = append(down.Warnings, "Extraction failed: "+err.Error())
+			}
+		}
+		down.runHooks()
 	}()
 }
 
+// after rebuilding stopped at end, the first part has everything before it
+func (down *Download) keepRebuilt(end int64) {
+	first := down.jobsDone[0]
+	first.length, first.received = end, end
+	parts := []*downJob{first}
+	for _, job := range down.jobsDone[1:] {
+		if job.offset >= end { // not yet copied
+			parts = append(parts, job)
+		}
+	}
+	down.jobsDone = parts
+	for _, job := range parts {
+		job.file.Close() // some may be closed already
+	}
+}
+
+// rename, or copy if on different filesystems
+func moveFile(src, dst string) error {
+	renameErr := os.Rename(src, dst)
+	if renameErr == nil {
+		return nil
+	}
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return renameErr
+	}
+	defer srcFile.Close()
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return renameErr
+	}
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := dstFile.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	srcFile.Close()
+	return os.Remove(src)
+}
+
 func (down *Download) saveProgress() error {
 	prog := Progress{
-		Id:       down.Id,
-		Url:      down.Url,
-		Filename: down.Filename,
+		Id:        down.Id,
+		Url:       down.CurrentUrl(),
+		Filename:  down.Filename,
+		Resumable: down.Resumable,
+		Options:   down.Options(),
+		Replaces:  down.replaces,
 	}
-	for _, job := range down.jobsDone {
-		jobProg := map[string]int64{
-			"offset":   job.offset,
-			"length":   job.length,
-			"received": job.received,
+	for _, name := range secretHeaders {
+		prog.Options.Header.Del(name)
+	}
+	for _, jobs := range [][]*downJob{down.jobsDone, down.jobList()} {
+		for _, job := range jobs {
+			jobProg := map[string]int64{
+				"offset":   job.offset,
+				"length":   job.length,
+				"received": job.received,
+			}
+			prog.Parts = append(prog.Parts, jobProg)
 		}
-		prog.Parts = append(prog.Parts, jobProg)
 	}
-	f, err := os.Create(filepath.Join(down.Dir, PART_DIR_NAME, fmt.Sprintf("%s.%d%s", down.Filename, down.Id, PROG_FILE_EXT)))
+	content, err := json.Marshal(prog)
 	if err != nil {
 		return err
 	}
-	json.NewEncoder(f).Encode(prog)
-	f.Close()
-	return nil
+	if len(content) < PROG_FILE_SIZE { // keep the reserved space
+		content = append(content, bytes.Repeat([]byte(" "), PROG_FILE_SIZE-len(content))...)
+	}
+	// written over the reserved space without truncating, to work when the disk is
+	// full. only readable by the user, like the cookies
+	f, err := os.OpenFile(down.ProgressFile(), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	// the end of a longer one before, only shrinks
+	if err := f.Truncate(int64(len(content))); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// the jobs in progress, sorted by offset
+func (down *Download) jobList() []*downJob {
+	var jobs []*downJob
+	for _, job := range down.Jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].offset < jobs[j].offset
+	})
+	return jobs
+}
+
+// ProgressFile gives the path of the file where the progress is saved
+func (down *Download) ProgressFile() string {
+	return filepath.Join(down.Dir, PART_DIR_NAME, fmt.Sprintf("%s.%d%s", down.Filename, down.Id, PROG_FILE_EXT))
 }
 
 func (down *Download) Resume(progressFile string) (err error) {
+	if err := down.lockProgress(progressFile); err != nil { // not resumed twice
+		return err
+	}
 	defer func() {
 		if err != nil {
 			for _, job := range down.Jobs {
 				job.file.Close()
 			}
+			down.unlockProgress()
 		}
 	}()
-	var prog Progress
+	prog := Progress{Resumable: true} // for those saved without it
 	f, err := os.Open(progressFile)
 	if err != nil {
 		return err
@@ -524,6 +1451,34 @@ func (down *Download) Resume(progressFile string) (err error) {
 	}
 	down.Dir = filepath.Dir(filepath.Dir(progressFile))
 	down.Filename = prog.Filename
+	down.Resumable = prog.Resumable
+	down.replaces = prog.Replaces
+	given := down.Options() // take precedence over the saved ones
+	down.SetOptions(prog.Options)
+	down.SetOptions(given)
+	if len(prog.Parts) == 0 {
+		return fmt.Errorf("No parts in the progress file")
+	}
+	if !down.Resumable { // start over, single stream
+		file, err := os.OpenFile(down.jobFileName(0), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 666)
+		if err != nil {
+			return err
+		}
+		job := &downJob{file: file}
+		down.Jobs[0] = job
+		if down.getResponse(job); job.err != nil {
+			return job.err
+		}
+		for _, part := range prog.Parts[1:] { // not expected, but just in case
+			os.Remove(down.jobFileName(part["offset"]))
+		}
+		down.Length = job.length
+		down.reserveProgress(progressFile)
+		down.initJob(job)
+		go down.download(job)
+		go down.coordinate()
+		return nil
+	}
 	for _, job := range prog.Parts {
 		newJob := &downJob{
 			offset:   job["offset"],
@@ -538,15 +1493,14 @@ func (down *Download) Resume(progressFile string) (err error) {
 		if err != nil {
 			return err
 		}
-		if flen := stat.Size(); flen != newJob.received {
-			if flen < newJob.received { // known size is incorrect, redownload the missing data
-				newJob.received = flen
-			} else if flen > newJob.length  {
-				// for some reason, the file is bigger than desired, truncate to desired size
-				if err := file.Truncate(newJob.length); err != nil {
-					return err
-				}
+		if flen := stat.Size(); flen > newJob.length {
+			// for some reason, the file is bigger than desired, truncate to desired size
+			if err := file.Truncate(newJob.length); err != nil {
+				return err
 			}
+			newJob.received = newJob.length
+		} else { // the file knows better, the count may have missed some
+			newJob.received = flen
 		}
 		if _, err := file.Seek(0, io.SeekEnd); err != nil { // go to the end
 			return err
@@ -559,6 +1513,21 @@ func (down *Download) Resume(progressFile string) (err error) {
 		}
 		down.Length += newJob.length
 	}
+	var remaining, overhead int64
+	for _, job := range down.Jobs {
+		remaining += job.length - job.received
+		if job.offset > 0 && job.length > overhead { // copied before removed
+			overhead = job.length
+		}
+	}
+	for _, job := range down.jobsDone {
+		if job.offset > 0 && job.length > overhead {
+			overhead = job.length
+		}
+	}
+	if err := down.checkSpace(remaining, overhead); err != nil {
+		return err
+	}
 	// make requests
 	requestErr := make(chan error)
 	request := func(job *downJob) {
@@ -574,23 +1543,90 @@ func (down *Download) Resume(progressFile string) (err error) {
 			return err
 		}
 	}
+	down.reserveProgress(progressFile)
 	for _, job := range down.Jobs {
 		down.initJob(job)
 		go down.download(job)
 	}
 	go down.coordinate()
-	os.Remove(progressFile)
 	return nil
 }
 
+// replace the progress file being resumed from with the reserved one
+func (down *Download) reserveProgress(progressFile string) {
+	old, err1 := filepath.Abs(progressFile)
+	current, err2 := filepath.Abs(down.ProgressFile())
+	if err1 != nil || err2 != nil || old != current {
+		os.Remove(progressFile)
+		down.lockProgress(down.ProgressFile())
+	}
+	down.saveProgress()
+}
+
+func lockPath(progressFile string) string {
+	return strings.TrimSuffix(progressFile, PROG_FILE_EXT) + LOCK_FILE_EXT
+}
+
+// hold a lock beside the progress file while downloading, to tell the
+// scanners that it is not abandoned. ActiveError if held elsewhere
+func (down *Download) lockProgress(progressFile string) error {
+	path := lockPath(progressFile)
+	if down.lock != nil && down.lock.Name() == path {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil // not lockable, like a read only dir which will fail later anyway
+	}
+	if err := lockFile(file); err == ActiveError {
+		file.Close()
+		return err
+	} else if err != nil { // not supported by the filesystem
+		file.Close()
+		os.Remove(path)
+		return nil
+	}
+	down.unlockProgress()
+	down.lock = file
+	return nil
+}
+
+func (down *Download) unlockProgress() {
+	if down.lock == nil {
+		return
+	}
+	unlockFile(down.lock)
+	down.lock.Close()
+	os.Remove(down.lock.Name())
+	down.lock = nil
+}
+
+// whether the download of the progress file is running somewhere
+func isActive(progressFile string) bool {
+	file, err := os.Open(lockPath(progressFile))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	if err := lockFile(file); err != nil {
+		return err == ActiveError
+	}
+	unlockFile(file)
+	return false
+}
+
 type Progress struct {
-	Id       int                `json:"id"`
-	Url      string             `json:"url"`
-	Filename string             `json:"filename"`
-	Parts    []map[string]int64 `json:"parts"`
+	Id        int                `json:"id"`
+	Url       string             `json:"url"`
+	Filename  string             `json:"filename"`
+	Resumable bool               `json:"resumable"`
+	Options   Options            `json:"options"`
+	Replaces  string             `json:"replaces,omitempty"` // when complete, to overwrite
+	Parts     []map[string]int64 `json:"parts"`
 }
 
-func New(url string, maxConns int, id int, dir string) *Download {
+// New makes a download, with the options if given
+func New(url string, maxConns int, id int, dir string, options ...Options) *Download {
 	down := Download{
 		Id:        id,
 		Url:       url,
@@ -603,6 +1639,10 @@ func New(url string, maxConns int, id int, dir string) *Download {
 		insertJob: make(chan [2]*downJob),
 		checkJob:  make(chan checkJob, 10),
 		jobDone:   make(chan *downJob),
+		changed:   make(chan bool, 1),
+	}
+	for _, opts := range options {
+		down.SetOptions(opts)
 	}
 	return &down
 }
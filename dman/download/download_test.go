@@ -3,9 +3,24 @@
 package download
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"math/rand"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
 	// "fmt"
 )
 
@@ -31,6 +46,15 @@ func TestFilename(t *testing.T) {
 	if fname := getFilename(&resp); fname != fromHeader {
 		t.Errorf("Wrong filename from Header: %s != %s", fname, fromHeader)
 	}
+	resp.Header.Set("Content-Disposition", "attachment; filename=../../.profile")
+	if fname := getFilename(&resp); fname != ".profile" {
+		t.Errorf("Unsafe filename from Header: %s", fname)
+	}
+	for _, name := range []string{"", ".", "..", "/", "foo/.."} {
+		if clean := CleanFilename(name); clean != "" {
+			t.Errorf("Unusable name '%s' accepted as '%s'", name, clean)
+		}
+	}
 }
 
 func TestReadableSize(t *testing.T) {
@@ -39,8 +63,909 @@ func TestReadableSize(t *testing.T) {
 			1024 * 1024: "1.00MB",
 			1024 * 1024 * (1024 + 512): "1.50GB",
 		} {
-		if size := readableSize(raw); size != readable {
+		if size := ReadableSize(raw); size != readable {
 			t.Errorf("Wrong readable size: %s != %s", size, readable)
 		}
 	}
 }
+
+func TestChangeConns(t *testing.T) {
+	content := make([]byte, 1000000)
+	rand.New(rand.NewSource(1)).Read(content)
+	gate := make(chan bool) // the responses stall after their start until closed
+	var sent int64          // before the gate is opened
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		http.ServeContent(recorder, r, "", time.Time{}, bytes.NewReader(content))
+		for name, values := range recorder.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(recorder.Code)
+		body := recorder.Body.Bytes()
+		start := body
+		if len(start) > 32*1024 {
+			start = start[:32*1024]
+		}
+		w.Write(start)
+		w.(http.Flusher).Flush()
+		atomic.AddInt64(&sent, int64(len(start)))
+		<-gate
+		w.Write(body[len(start):])
+	}))
+	defer server.Close()
+	var opened time.Time
+	open := func() {
+		if opened.IsZero() {
+			opened = time.Now()
+			close(gate)
+		}
+	}
+	defer open()
+	dir, err := ioutil.TempDir("", "dman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const limit = 500000
+	down := New(server.URL+"/file.bin", 2, 0, dir)
+	if err := down.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var ticks, most int
+	var remaining int64 // when the gate was opened
+	for done := false; !done; {
+		select {
+		case stat := <-down.Status:
+			ticks++
+			if stat.Conns > most {
+				most = stat.Conns
+			}
+			switch {
+			case ticks == 2: // stalled, no eta to prevent splitting
+				down.SetMaxConns(6)
+			case ticks > 2 && down.MaxConns() > 1 && (most == 6 || ticks == 10):
+				down.SetMaxConns(1)
+			case down.MaxConns() == 1 && opened.IsZero() && stat.Conns == 1:
+				down.SetLimit(limit)
+				remaining = int64(len(content)) - atomic.LoadInt64(&sent)
+				open()
+			case !opened.IsZero() && stat.Conns > 1:
+				t.Errorf("Connections not reduced: %d", stat.Conns)
+			}
+		case err := <-down.Err:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		}
+	}
+	if most != 6 {
+		t.Errorf("Connections not increased: %d", most)
+	}
+	if opened.IsZero() {
+		t.Fatal("Finished before the connections were reduced")
+	}
+	if elapsed, min := time.Since(opened), time.Duration(remaining)*time.Second/limit*9/10; elapsed < min {
+		t.Errorf("Faster than the limit: %v < %v", elapsed, min)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "file.bin")); !bytes.Equal(got, content) {
+		t.Errorf("Wrong content after changing connections, %d bytes", len(got))
+	}
+}
+
+func TestRefreshUrl(t *testing.T) {
+	down := New("http://example.com/old", 1, 0, "")
+	var calls int32
+	answer := make(chan string)
+	down.ResolveUrl = func(status int) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return <-answer, nil
+	}
+	results := make(chan bool)
+	for i := 0; i < 3; i++ {
+		go func() {
+			results <- down.refreshUrl("http://example.com/old", 403)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if url := down.CurrentUrl(); url != "http://example.com/old" { // not blocked meanwhile
+		t.Errorf("Wrong url while refreshing: %s", url)
+	}
+	answer <- "http://example.com/new"
+	for i := 0; i < 3; i++ {
+		if !<-results {
+			t.Error("Not refreshed")
+		}
+	}
+	if calls != 1 || down.CurrentUrl() != "http://example.com/new" {
+		t.Errorf("Wrong refresh: %d calls, %s", calls, down.CurrentUrl())
+	}
+}
+
+func TestCheckParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, PART_DIR_NAME), 0755)
+	down := New("", 1, 0, dir)
+	down.Filename = "foo"
+	down.Length = 40
+	// full, short, too long, then missing at the end
+	for _, part := range [][3]int64{{0, 10, 10}, {10, 10, 6}, {20, 10, 12}} {
+		file, err := os.Create(down.jobFileName(part[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		file.Write(make([]byte, part[2]))
+		down.jobsDone = append(down.jobsDone, &downJob{offset: part[0], length: part[1], received: part[2], file: file})
+	}
+	broken, err := down.checkParts()
+	if err != nil || !broken {
+		t.Fatalf("Broken parts not found: %v", err)
+	}
+	if len(down.jobsDone) != 2 || len(down.pending) != 2 {
+		t.Fatalf("Wrong parts: %d good, %d pending", len(down.jobsDone), len(down.pending))
+	}
+	if short := down.pending[0]; short.offset != 10 || short.received != 6 {
+		t.Errorf("Wrong short part: %d from %d", short.received, short.offset)
+	}
+	if gap := down.pending[1]; gap.offset != 30 || gap.length != 10 {
+		t.Errorf("Wrong missing part: %d from %d", gap.length, gap.offset)
+	}
+	if stat, _ := down.jobsDone[1].file.Stat(); stat.Size() != 10 {
+		t.Errorf("Long part not truncated: %d", stat.Size())
+	}
+}
+
+func TestResolveName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.zip"), make([]byte, 10), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for policy, expected := range map[Conflict]error{
+		CONFLICT_SKIP: SkippedError,
+		CONFLICT_FAIL: FileExistsError,
+		CONFLICT_RESUME: SkippedError,
+	} {
+		down := New("", 1, 0, dir)
+		down.Filename, down.Length, down.Conflict = "foo.zip", 10, policy
+		if _, err := down.resolveName(); err != expected {
+			t.Errorf("Wrong result for %s: %v != %v", policy, err, expected)
+		}
+	}
+	down := New("", 1, 0, dir)
+	down.Filename, down.Length, down.Resumable, down.Conflict = "foo.zip", 20, true, CONFLICT_RESUME
+	if existing, err := down.resolveName(); err != nil || existing != 10 {
+		t.Errorf("Wrong size to resume: %d, %v", existing, err)
+	}
+	for _, renamed := range []string{"foo (1).zip", "foo (2).zip"} { // reserved for the next
+		down := New("", 1, 0, dir)
+		down.Filename, down.Length = "foo.zip", 20
+		if _, err := down.resolveName(); err != nil || down.Filename != renamed {
+			t.Errorf("Wrong new name: %s != %s, %v", down.Filename, renamed, err)
+		}
+	}
+	// identical by the checksum as well
+	zeros := md5.Sum(make([]byte, 10))
+	for checksum, expected := range map[string]error{
+		"md5=" + hex.EncodeToString(zeros[:]): SkippedError,
+		"md5=00112233445566778899aabbccddeeff": nil, // renamed
+	} {
+		down := New("", 1, 0, dir)
+		down.Filename, down.Length, down.Conflict, down.Checksum = "foo.zip", 10, CONFLICT_SKIP, checksum
+		if _, err := down.resolveName(); err != expected {
+			t.Errorf("Wrong result for %s: %v != %v", checksum, err, expected)
+		}
+	}
+	// overwritten when complete, downloaded under a reserved name
+	down = New("", 1, 0, dir)
+	down.Filename, down.Conflict = "foo.zip", CONFLICT_OVERWRITE
+	if _, err := down.resolveName(); err != nil || down.Filename != "foo (4).zip" || down.replaces != "foo.zip" {
+		t.Errorf("Wrong overwrite name: %s for %s, %v", down.Filename, down.replaces, err)
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "foo.zip")); err != nil || stat.Size() != 10 {
+		t.Errorf("Overwritten file changed at start: %v", err)
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "none")
+		w.Header().Set("Content-Length", "20")
+		if strings.HasPrefix(r.URL.Path, "/fail") { // cut short
+			w.Write([]byte("new"))
+			return
+		}
+		w.Write([]byte("new content is here."))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "dman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "foo.txt")
+	for _, urlPath := range []string{"/fail/foo.txt", "/ok/foo.txt"} {
+		ioutil.WriteFile(path, []byte("original"), 0644)
+		down := New(server.URL+urlPath, 1, 0, dir)
+		down.Filename, down.Conflict = "foo.txt", CONFLICT_OVERWRITE
+		if err := down.Start(); err != nil {
+			t.Fatal(err)
+		}
+		err := <-down.Err
+		content, _ := ioutil.ReadFile(path)
+		if urlPath == "/fail/foo.txt" && (err == nil || string(content) != "original") {
+			t.Errorf("Original not kept when failed: %q, %v", content, err)
+		} else if urlPath == "/ok/foo.txt" && (err != nil || string(content) != "new content is here." || down.Filename != "foo.txt") {
+			t.Errorf("Not overwritten: %q as %s, %v", content, down.Filename, err)
+		}
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "foo (*")); len(names) != 1 { // the failed one
+		t.Errorf("Wrong reserved names left: %v", names)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "hooks.json")
+	isoDir := filepath.Join(dir, "isos")
+	content := `[{"move": [{"pattern": "*.iso", "dir": "` + filepath.ToSlash(isoDir) + `"}]}, {"chmod": "0600"}, {"run": ["/nonexistent"]}]`
+	if err := ioutil.WriteFile(config, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	hooks, err := LoadHooks(config)
+	if err != nil || len(hooks) != 3 {
+		t.Fatalf("Hooks not loaded: %d, %v", len(hooks), err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.iso"), make([]byte, 10), 0666); err != nil {
+		t.Fatal(err)
+	}
+	down := New("", 1, 0, dir)
+	down.Filename, down.Length, down.Hooks = "foo.iso", 10, hooks
+	down.runHooks()
+	if down.Dir != isoDir {
+		t.Errorf("Not moved: %s", down.Dir)
+	}
+	if _, err := os.Stat(filepath.Join(isoDir, "foo.iso")); err != nil {
+		t.Errorf("Moved file missing: %v", err)
+	}
+	if len(down.Warnings) != 1 {
+		t.Errorf("Wrong warnings: %v", down.Warnings)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// zip slip
+	var zipped bytes.Buffer
+	archive := zip.NewWriter(&zipped)
+	entry, _ := archive.Create("../evil.txt")
+	entry.Write([]byte("evil"))
+	archive.Close()
+	ioutil.WriteFile(filepath.Join(dir, "evil.zip"), zipped.Bytes(), 0666)
+	down := New("", 1, 0, dir)
+	down.Filename = "evil.zip"
+	if err := down.extract(); err == nil {
+		t.Error("Unsafe path not refused")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.txt")); err == nil {
+		t.Error("File extracted outside")
+	}
+	// split tar.gz
+	var tarred bytes.Buffer
+	gz := gzip.NewWriter(&tarred)
+	tarArchive := tar.NewWriter(gz)
+	content := []byte("content")
+	tarArchive.WriteHeader(&tar.Header{Name: "a/b.txt", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	tarArchive.Write(content)
+	tarArchive.Close()
+	gz.Close()
+	half := tarred.Len() / 2
+	ioutil.WriteFile(filepath.Join(dir, "foo.tar.gz.001"), tarred.Bytes()[:half], 0666)
+	ioutil.WriteFile(filepath.Join(dir, "foo.tar.gz.002"), tarred.Bytes()[half:], 0666)
+	down = New("", 1, 0, dir)
+	down.Filename = "foo.tar.gz.002"
+	if err := down.extract(); err != nil {
+		t.Fatal(err)
+	}
+	if down.Filename != "foo.tar.gz" {
+		t.Errorf("Parts not joined: %s", down.Filename)
+	}
+	if extracted, err := ioutil.ReadFile(filepath.Join(dir, "foo", "a", "b.txt")); err != nil || string(extracted) != "content" {
+		t.Errorf("Wrong extracted content: %q, %v", extracted, err)
+	}
+	// escaping through the links already extracted
+	for name, entries := range map[string][]tar.Header{
+		"chain.tar": {
+			{Name: "a", Linkname: ".", Typeflag: tar.TypeSymlink},
+			{Name: "a/b", Linkname: "..", Typeflag: tar.TypeSymlink},
+			{Name: "a/b/evil.txt", Mode: 0644, Size: 4, Typeflag: tar.TypeReg},
+		},
+		"dotdot.tar": {
+			{Name: "x", Linkname: ".", Typeflag: tar.TypeSymlink},
+			{Name: "y", Linkname: "x/..", Typeflag: tar.TypeSymlink},
+			{Name: "y/evil.txt", Mode: 0644, Size: 4, Typeflag: tar.TypeReg},
+		},
+		"through.tar": {
+			{Name: "l", Linkname: "t.txt", Typeflag: tar.TypeSymlink},
+			{Name: "l", Mode: 0644, Size: 4, Typeflag: tar.TypeReg},
+		},
+	} {
+		var buf bytes.Buffer
+		tarArchive = tar.NewWriter(&buf)
+		for _, header := range entries {
+			header := header
+			tarArchive.WriteHeader(&header)
+			if header.Typeflag == tar.TypeReg {
+				tarArchive.Write([]byte("evil"))
+			}
+		}
+		tarArchive.Close()
+		ioutil.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0666)
+		down = New("", 1, 0, dir)
+		down.Filename = name
+		if err := down.extract(); err == nil {
+			t.Errorf("Unsafe links in %s not refused", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "evil.txt")); err == nil {
+			t.Errorf("File extracted outside from %s", name)
+			os.Remove(filepath.Join(dir, "evil.txt"))
+		}
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	for checksum, valid := range map[string]bool{
+		"sha-256=2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824": true,
+		"SHA1=aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d": true,
+		"md5=5d41402abc4b2a76b9719d911017c592": true,
+		"crc32=3610a686": false,
+		"sha-256": false,
+		"md5=xyz": false,
+	} {
+		if _, _, err := parseChecksum(checksum); (err == nil) != valid {
+			t.Errorf("Wrong result for %s: %v", checksum, err)
+		}
+	}
+}
+
+func TestExpandPattern(t *testing.T) {
+	for pattern, expected := range map[string][]string{
+		"http://h/scan_[001-003].tif": {"http://h/scan_001.tif", "http://h/scan_002.tif", "http://h/scan_003.tif"},
+		"http://h/[0-10:5]/{a,b}": {"http://h/0/a", "http://h/0/b", "http://h/5/a", "http://h/5/b", "http://h/10/a", "http://h/10/b"},
+		"http://h/[x-z]": {"http://h/x", "http://h/y", "http://h/z"},
+		"http://[::1]/{a}": {"http://[::1]/{a}"},
+	} {
+		urls, err := ExpandPattern(pattern)
+		if err != nil {
+			t.Errorf("Failed for %s: %v", pattern, err)
+		} else if strings.Join(urls, " ") != strings.Join(expected, " ") {
+			t.Errorf("Wrong expansion of %s: %v", pattern, urls)
+		}
+	}
+	for _, pattern := range []string{"http://h/[5-1]", "http://h/[1-5:0]", "http://h/[a-Z]"} {
+		if _, err := ExpandPattern(pattern); err == nil {
+			t.Errorf("Bad pattern accepted: %s", pattern)
+		}
+	}
+}
+
+func TestCrawl(t *testing.T) {
+	pages := map[string]string{
+		"/robots.txt": "User-agent: *\nDisallow: /pub/private/\n",
+		"/pub/": `<a href="?C=N;O=D">Name</a> <a href="../">Parent</a> <a href="sub/">sub/</a>
+			<a href="a.iso">a.iso</a> <a href='b.txt'>b.txt</a> <a href="private/">private/</a>
+			<a href="http://other.example/x.iso">x.iso</a>`,
+		"/pub/sub/":     `<a href="c.iso">c.iso</a> <a href="deeper/">deeper/</a>`,
+		"/pub/private/": `<a href="p.iso">p.iso</a>`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") {
+			w.Header().Set("Content-Type", "text/html")
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+	crawler := Crawler{Depth: 1, Include: []string{"*.iso"}, Robots: true}
+	files, err := crawler.Crawl(server.URL + "/pub/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, file := range files {
+		found = append(found, file.Path)
+	}
+	if strings.Join(found, " ") != "a.iso sub/c.iso" {
+		t.Errorf("Wrong files found: %v", found)
+	}
+}
+
+func TestListPartials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, PART_DIR_NAME), 0755)
+	down := New("http://example.com/foo.zip", 2, 3, dir)
+	down.Filename, down.Resumable = "foo.zip", true
+	for _, part := range [][3]int64{{0, 50, 50}, {50, 50, 20}} {
+		file, err := os.Create(down.jobFileName(part[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(make([]byte, part[2]))
+		file.Close()
+		down.Jobs[part[0]] = &downJob{offset: part[0], length: part[1], received: part[2], file: file}
+	}
+	if err := down.saveProgress(); err != nil {
+		t.Fatal(err)
+	}
+	partials, err := ListPartials(dir)
+	if err != nil || len(partials) != 1 {
+		t.Fatalf("Partial not found: %v", err)
+	}
+	if partial := partials[0]; partial.Length != 100 || partial.Written != 70 || partial.Url != down.Url {
+		t.Errorf("Wrong partial: %d of %d from %s", partial.Written, partial.Length, partial.Url)
+	}
+	if err := partials[0].Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, PART_DIR_NAME)); !os.IsNotExist(err) {
+		t.Errorf("Parts not removed: %v", err)
+	}
+}
+
+func TestRemovePartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	partDir := filepath.Join(dir, PART_DIR_NAME)
+	os.Mkdir(partDir, 0755)
+	// without the progress file, and with another download's files
+	files := []string{"foo.zip.3.0", "foo.zip.3.500", "foo.zip.3.5.dman", "foo.zip.3.5.0", "foo.zip.4.0"}
+	for _, name := range files {
+		ioutil.WriteFile(filepath.Join(partDir, name), []byte("data"), 0644)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "foo.zip"), nil, 0644)
+	removed, err := RemovePartial(dir, "foo.zip", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 3 || removed[2] != filepath.Join(dir, "foo.zip") {
+		t.Errorf("Wrong files removed: %v", removed)
+	}
+	for _, name := range files[2:] {
+		if _, err := os.Stat(filepath.Join(partDir, name)); err != nil {
+			t.Errorf("Removed another's file: %v", err)
+		}
+	}
+}
+
+func TestScanPartials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub", "deeper")
+	os.MkdirAll(filepath.Join(sub, PART_DIR_NAME), 0755)
+	down := New("http://example.com/foo.zip", 1, 3, sub)
+	down.Filename, down.Resumable = "foo.zip", true
+	down.Jobs[0] = &downJob{offset: 0, length: 100}
+	if err := down.saveProgress(); err != nil {
+		t.Fatal(err)
+	}
+	// parts of a download whose progress file is gone, a bad progress file
+	files := []string{"foo.zip.3.0", "bar.iso.5.0", "bar.iso.5.300", "baz.bin.6.dman", "not-a-part"}
+	for _, name := range files {
+		ioutil.WriteFile(filepath.Join(sub, PART_DIR_NAME, name), []byte("data"), 0644)
+	}
+	if partials, strays, _ := ScanPartials(dir, false); len(partials)+len(strays) != 0 {
+		t.Errorf("Found in the subdirs when not recursive: %d, %d", len(partials), len(strays))
+	}
+	partials, strays, err := ScanPartials(dir, true)
+	if err == nil {
+		t.Error("No error for the bad progress file")
+	}
+	if len(partials) != 1 || partials[0].Dir != sub || partials[0].Written != 4 {
+		t.Errorf("Wrong partials: %+v", partials)
+	}
+	if len(strays) != 3 {
+		t.Fatalf("Wrong strays: %+v", strays)
+	}
+	for _, stray := range strays {
+		if err := stray.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, strays, _ := ScanPartials(dir, true); len(strays) != 0 {
+		t.Errorf("Strays not removed: %+v", strays)
+	}
+	// a progress file that shrinks past the reserved size
+	down.Header = http.Header{"X-Long": {strings.Repeat("x", 2*PROG_FILE_SIZE)}}
+	if err := down.saveProgress(); err != nil {
+		t.Fatal(err)
+	}
+	down.Header = nil
+	if err := down.saveProgress(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPartial(down.ProgressFile()); err != nil {
+		t.Errorf("Shrunk progress file not readable: %v", err)
+	}
+	// a running download is not partial
+	if err := down.lockProgress(down.ProgressFile()); err != nil {
+		t.Fatal(err)
+	}
+	if partials, strays, _ := ScanPartials(dir, true); len(partials)+len(strays) != 0 {
+		t.Errorf("Running download found: %+v, %+v", partials, strays)
+	}
+	if _, err := RemovePartial(sub, "foo.zip", 3); err != ActiveError {
+		t.Errorf("Running download removed: %v", err)
+	}
+	other := New("", 1, 0, "")
+	if err := other.Resume(down.ProgressFile()); err != ActiveError {
+		t.Errorf("Running download resumed again: %v", err)
+	}
+	down.unlockProgress()
+	if partials, _, _ := ScanPartials(dir, true); len(partials) != 1 {
+		t.Errorf("Stopped download not found: %+v", partials)
+	}
+}
+
+func TestResumeOptions(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		cookie, err := r.Cookie("sid")
+		if r.Method != "POST" || string(body) != "q=1" || r.Header.Get("X-Token") != "t" || err != nil || cookie.Value != "new" {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "dman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, PART_DIR_NAME), 0755)
+	down := New(server.URL+"/foo", 1, 3, dir, Options{
+		Filename: "foo.bin",
+		Header:   http.Header{"X-Token": {"t"}, "Authorization": {"Bearer secret"}},
+		Cookies:  map[string]string{"sid": "old"},
+		Method:   "POST",
+		Body:     "q=1",
+		Priority: 2,
+	})
+	down.Resumable = true
+	file, err := os.Create(down.jobFileName(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(content[:40])
+	file.Close()
+	down.Jobs[0] = &downJob{offset: 0, length: 100, received: 40}
+	if err := down.saveProgress(); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := ioutil.ReadFile(down.ProgressFile()); bytes.Contains(saved, []byte("secret")) || bytes.Contains(saved, []byte("sid")) {
+		t.Errorf("Credentials saved: %s", bytes.TrimSpace(saved))
+	}
+	// the given ones take precedence over the saved ones
+	resumed := New("", 1, 0, "", Options{Cookies: map[string]string{"sid": "new"}})
+	if err := resumed.Resume(down.ProgressFile()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-resumed.Err; err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Method != "POST" || resumed.Priority != 2 || resumed.Filename != "foo.bin" {
+		t.Errorf("Options not restored: %+v", resumed.Options())
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "foo.bin")); !bytes.Equal(got, content) {
+		t.Errorf("Wrong content: %q", got)
+	}
+	for range resumed.Status { // until it has ended
+	}
+	resumed.Pause() // not a send on the closed Stop
+	// a truncated one, not resumable
+	empty := filepath.Join(dir, PART_DIR_NAME, "bar.bin.4"+PROG_FILE_EXT)
+	ioutil.WriteFile(empty, []byte(`{"id": 4, "filename": "bar.bin", "resumable": false, "parts": []}`), 0644)
+	if err := New(server.URL+"/bar", 1, 0, "").Resume(empty); err == nil {
+		t.Error("Resumed without parts")
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cookies.txt")
+	ioutil.WriteFile(path, []byte(strings.Join([]string{
+		"# Netscape HTTP Cookie File",
+		".example.com\tTRUE\t/\tFALSE\t0\tall\t1",
+		"example.com\tFALSE\t/files\tFALSE\t0\tfiles\t2",
+		"#HttpOnly_.example.com\tTRUE\t/\tTRUE\t0\tsecure\t3",
+		".example.com\tTRUE\t/\tFALSE\t1\texpired\t4",
+		"other.com\tFALSE\t/\tFALSE\t0\tother\t5",
+	}, "\n")), 0644)
+	jar, err := LoadCookies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(rawurl string) string {
+		URL, _ := url.Parse(rawurl)
+		var found []string
+		for _, cookie := range jar.Cookies(URL) {
+			found = append(found, cookie.Name)
+		}
+		return strings.Join(found, " ")
+	}
+	for rawurl, expected := range map[string]string{
+		"http://example.com/files/a.zip":     "files all",
+		"http://example.com/filesx":          "all",
+		"https://dl.example.com/files/a.zip": "all secure",
+		"http://example.com:8080/files":      "files all",
+		"http://notexample.com/files/a.zip":  "",
+	} {
+		if found := names(rawurl); found != expected {
+			t.Errorf("Wrong cookies for %s: '%s' != '%s'", rawurl, found, expected)
+		}
+	}
+	URL, _ := url.Parse("http://dl.example.com/files/a.zip")
+	jar.SetCookies(URL, []*http.Cookie{
+		{Name: "session", Value: "6"},
+		{Name: "all", Value: "7", Domain: "example.com", Path: "/"},
+		{Name: "evil", Value: "8", Domain: "other.com"},
+		{Name: "tld", Value: "9", Domain: ".com"},
+		{Name: "kept", Value: "10", Domain: "example.com", Path: "/other", Expires: time.Now().Add(time.Hour)},
+	})
+	saved := jar
+	if err := saved.Save(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("Cookies readable by others: %v", info.Mode())
+	}
+	if jar, err = LoadCookies(path); err != nil {
+		t.Fatal(err)
+	}
+	if found := names("http://example.com/other/c.zip"); found != "kept" {
+		t.Errorf("Wrong cookies without the session ones: '%s'", found)
+	}
+	if err := saved.Save(path, true); err != nil {
+		t.Fatal(err)
+	}
+	if jar, err = LoadCookies(path); err != nil {
+		t.Fatal(err)
+	}
+	if found := names("http://dl.example.com/files/b.zip"); found != "session all" {
+		t.Errorf("Wrong cookies after saving: '%s'", found)
+	}
+	if found := names("http://another.com/"); found != "" {
+		t.Errorf("Cookies for a top level domain kept: '%s'", found)
+	}
+	if cookies := jar.Cookies(URL); len(cookies) != 2 || cookies[1].Value != "7" {
+		t.Errorf("Cookie not replaced: %v", cookies)
+	}
+}
+
+func TestParseCurl(t *testing.T) {
+	command := `curl 'https://example.com/dl?id=1' \
+  -H 'authority: example.com' \
+  -H 'accept-encoding: gzip, deflate, br' \
+  -H $'cookie: a=1; b=it\'s' \
+  -H "referer: https://example.com/\"files\"" \
+  -b 'c=3' \
+  --data-raw 'x=1' \
+  --compressed`
+	rawurl, opts, err := ParseCurl(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rawurl != "https://example.com/dl?id=1" || opts.Method != "POST" || opts.Body != "x=1" {
+		t.Errorf("Wrong request: %s %s %s", opts.Method, rawurl, opts.Body)
+	}
+	if opts.Cookies["a"] != "1" || opts.Cookies["b"] != "it's" || opts.Cookies["c"] != "3" {
+		t.Errorf("Wrong cookies: %v", opts.Cookies)
+	}
+	if len(opts.Header) != 2 || opts.Header.Get("Referer") != `https://example.com/"files"` {
+		t.Errorf("Wrong headers: %v", opts.Header)
+	}
+	if rawurl, opts, err = ParseCurl(`curl -sSG -XGET https://example.com/search -d q=a`); err != nil {
+		t.Fatal(err)
+	} else if rawurl != "https://example.com/search?q=a" || opts.Method != "" || opts.Body != "" {
+		t.Errorf("Wrong GET request: %s %s %s", opts.Method, rawurl, opts.Body)
+	}
+	if _, opts, err = ParseCurl(`curl -u me:pass https://example.com/a`); err != nil {
+		t.Fatal(err)
+	} else if opts.Credentials.User != "me" || opts.Credentials.Password != "pass" || len(opts.Header) != 0 {
+		t.Errorf("Wrong credentials: %+v, %v", opts.Credentials, opts.Header)
+	}
+	if _, _, err := ParseCurl(`curl 'https://example.com/a' --unknown`); err == nil {
+		t.Error("No error for an unsupported option")
+	}
+}
+
+func TestParseHAR(t *testing.T) {
+	har := `{"log": {"entries": [{"request": {
+		"method": "POST", "url": "https://example.com/dl",
+		"headers": [{"name": ":authority", "value": "example.com"}, {"name": "X-Token", "value": "t"}],
+		"cookies": [{"name": "a", "value": "1"}],
+		"postData": {"mimeType": "application/json", "text": "{}"}
+	}}]}}`
+	rawurl, opts, err := ParseHAR([]byte(har))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rawurl != "https://example.com/dl" || opts.Method != "POST" || opts.Body != "{}" || opts.Cookies["a"] != "1" {
+		t.Errorf("Wrong request: %s %s %s %v", opts.Method, rawurl, opts.Body, opts.Cookies)
+	}
+	if len(opts.Header) != 2 || opts.Header.Get("Content-Type") != "application/json" || opts.Header.Get("X-Token") != "t" {
+		t.Errorf("Wrong headers: %v", opts.Header)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	seen := map[string]bool{} // nonce counts
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/basic" {
+			if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "pass" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="files"`)
+				w.WriteHeader(401)
+				return
+			}
+			w.Write([]byte("ok"))
+			return
+		}
+		challenges := parseChallenges([]string{r.Header.Get("Authorization")})
+		if len(challenges) != 1 || challenges[0].scheme != "digest" {
+			w.Header().Add("WWW-Authenticate", `Basic realm="files"`)
+			w.Header().Add("WWW-Authenticate", `Digest realm="files", qop="auth,auth-int", nonce="abc", opaque="xyz"`)
+			w.WriteHeader(401)
+			return
+		}
+		params := challenges[0].params
+		digest := func(parts ...string) string {
+			sum := md5.Sum([]byte(strings.Join(parts, ":")))
+			return hex.EncodeToString(sum[:])
+		}
+		expected := digest(digest("user", "files", "pass"), "abc", params["nc"], params["cnonce"], "auth", digest(r.Method, r.URL.RequestURI()))
+		if params["response"] != expected || params["opaque"] != "xyz" || seen[params["nc"]] {
+			w.WriteHeader(403)
+			return
+		}
+		seen[params["nc"]] = true
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	down := New(server.URL+"/digest?a=1", 1, 0, ".")
+	down.Credentials = Credentials{User: "user", Password: "pass"}
+	for i := 0; i < 3; i++ { // like the connections, each with its own response
+		resp, err := down.request(down.Url, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("Digest request %d failed: %s", i, resp.Status)
+		}
+	}
+	asked := 0
+	down = New(server.URL+"/basic", 1, 0, ".")
+	down.Credentials = Credentials{User: "user", Password: "wrong"}
+	down.AskCredentials = func(realm string) (Credentials, error) {
+		asked++
+		return Credentials{User: "user", Password: "pass"}, nil
+	}
+	resp, err := down.request(down.Url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || asked != 1 {
+		t.Errorf("Basic request failed: %s, asked %d times", resp.Status, asked)
+	}
+	// the other connections are not blocked while asking
+	answer := make(chan Credentials)
+	down = New(server.URL+"/basic", 1, 0, ".")
+	down.AskCredentials = func(realm string) (Credentials, error) {
+		return <-answer, nil
+	}
+	result := make(chan int)
+	go func() {
+		resp, err := down.request(down.Url, "")
+		if err != nil {
+			t.Error(err)
+			result <- 0
+			return
+		}
+		resp.Body.Close()
+		result <- resp.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+	authorized := make(chan bool)
+	go func() {
+		req, _ := http.NewRequest("GET", down.Url, nil)
+		down.authorize(req)
+		authorized <- true
+	}()
+	select {
+	case <-authorized:
+	case <-time.After(time.Second):
+		t.Error("Blocked while asking for the credentials")
+	}
+	answer <- Credentials{User: "user", Password: "pass"}
+	if status := <-result; status != 200 {
+		t.Errorf("Request after asking failed: %d", status)
+	}
+	// .netrc credentials only for their host
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	ioutil.WriteFile(netrc, []byte("machine 127.0.0.1 login user password pass\n"), 0600)
+	os.Setenv("NETRC", netrc)
+	defer os.Unsetenv("NETRC")
+	down = New(server.URL+"/basic", 1, 0, ".")
+	down.Netrc = true
+	if resp, err := down.request(down.Url, ""); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Request with .netrc failed: %v, %v", resp, err)
+	}
+	other, _ := http.NewRequest("GET", "http://example.com/file", nil)
+	if down.authorize(other); other.Header.Get("Authorization") != "" {
+		t.Errorf("Credentials sent to another host: %s", other.Header.Get("Authorization"))
+	}
+}
+
+func TestReadNetrc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".netrc")
+	ioutil.WriteFile(path, []byte(`machine other.com login a password b
+macdef init
+machine example.com login evil
+
+machine example.com
+	login user
+	password pass
+default login anon password guest
+`), 0600)
+	for host, expected := range map[string]Credentials{
+		"example.com": {User: "user", Password: "pass"},
+		"unknown.com": {User: "anon", Password: "guest"},
+	} {
+		if cred, err := ReadNetrc(path, host); err != nil || cred != expected {
+			t.Errorf("Wrong credentials for %s: %+v, %v", host, cred, err)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+// -{go fmt %f}
+
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// archive suffixes and their formats, longer ones first
+var archiveFormats = [][2]string{
+	{".tar.gz", "tar.gz"},
+	{".tgz", "tar.gz"},
+	{".tar.xz", "tar.xz"},
+	{".txz", "tar.xz"},
+	{".tar", "tar"},
+	{".zip", "zip"},
+	{".gz", "gz"},
+}
+
+// parts of split archives, like foo.zip.001
+var splitPattern = regexp.MustCompile(`^(.+)\.(\d{3})$`)
+
+// parts of a split archive may finish at the same time
+var joinMutex sync.Mutex
+
+// the format of the archive and its name without the suffix, "" if not an archive
+func archiveFormat(name string) (string, string) {
+	lower := strings.ToLower(name)
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(lower, format[0]) {
+			return format[1], name[:len(name)-len(format[0])]
+		}
+	}
+	return "", name
+}
+
+// counts the bytes read for the progress
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+// the progress is measured with total bytes
+func (down *Download) setExtractTotal(total int64) {
+	atomic.StoreInt64(&down.extractDone, 0)
+	atomic.StoreInt64(&down.extractTotal, total)
+}
+
+// join the split archive parts and extract the archive, into ExtractDir, or
+// a dir with the archive's name beside it
+func (down *Download) extract() error {
+	defer down.setExtractTotal(0)
+	if err := down.joinSplit(); err != nil {
+		return err
+	}
+	format, base := archiveFormat(down.Filename)
+	if format == "" {
+		return nil
+	}
+	path := filepath.Join(down.Dir, down.Filename)
+	dest := down.ExtractDir
+	if dest == "" {
+		if format == "gz" { // a single file
+			dest = down.Dir
+		} else {
+			dest = filepath.Join(down.Dir, base)
+		}
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	// the links in the archive are checked against the real path
+	dest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	if format == "zip" {
+		return down.extractZip(path, dest)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	down.setExtractTotal(stat.Size())
+	reader := countingReader{file, &down.extractDone}
+	switch format {
+	case "gz":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		name, err := reserveName(dest, base)
+		if err != nil {
+			return err
+		}
+		return writeFile(dest, filepath.Join(dest, name), 0644, gz)
+	case "tar.gz":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return extractTar(gz, dest)
+	case "tar.xz": // no xz in the standard library
+		cmd := exec.Command("xz", "-dc")
+		cmd.Stdin = reader
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("Cannot run xz: %v", err)
+		}
+		if err := extractTar(out, dest); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+		return cmd.Wait()
+	}
+	return extractTar(reader, dest)
+}
+
+// join the parts of a split archive into one if this is the last to finish
+func (down *Download) joinSplit() error {
+	match := splitPattern.FindStringSubmatch(down.Filename)
+	if match == nil {
+		return nil
+	}
+	joinMutex.Lock()
+	defer joinMutex.Unlock()
+	var parts []string
+	var total int64
+	for i := 1; ; i++ {
+		part := fmt.Sprintf("%s.%0*d", match[1], len(match[2]), i)
+		stat, err := os.Stat(filepath.Join(down.Dir, part))
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return err
+		} else if stat.Size() == 0 { // reserved, still downloading
+			return nil
+		}
+		inProgress, err := filepath.Glob(filepath.Join(down.Dir, PART_DIR_NAME, part+".*"+PROG_FILE_EXT))
+		if err != nil {
+			return err
+		} else if len(inProgress) > 0 {
+			return nil
+		}
+		parts = append(parts, part)
+		total += stat.Size()
+	}
+	if len(parts) < 2 { // this may be a later part of a set that wasn't downloaded together
+		return nil
+	}
+	name, err := reserveName(down.Dir, match[1])
+	if err != nil {
+		return err
+	}
+	joined, err := os.Create(filepath.Join(down.Dir, name))
+	if err != nil {
+		return err
+	}
+	down.setExtractTotal(total)
+	for _, part := range parts {
+		file, err := os.Open(filepath.Join(down.Dir, part))
+		if err != nil {
+			joined.Close()
+			os.Remove(joined.Name())
+			return err
+		}
+		_, err = io.Copy(joined, countingReader{file, &down.extractDone})
+		file.Close()
+		if err != nil {
+			joined.Close()
+			os.Remove(joined.Name())
+			return err
+		}
+	}
+	if err := joined.Close(); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		os.Remove(filepath.Join(down.Dir, part))
+	}
+	down.Filename = name
+	return nil
+}
+
+func (down *Download) extractZip(path, dest string) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	var total int64
+	for _, file := range archive.File {
+		total += int64(file.UncompressedSize64)
+	}
+	down.setExtractTotal(total)
+	for _, file := range archive.File {
+		target, err := safePath(dest, file.Name)
+		if err != nil {
+			return err
+		}
+		mode := file.Mode()
+		if mode.IsDir() {
+			if err := makeDirInside(dest, target); err != nil {
+				return err
+			}
+			continue
+		}
+		content, err := file.Open()
+		if err != nil {
+			return err
+		}
+		reader := countingReader{content, &down.extractDone}
+		if mode&os.ModeSymlink != 0 {
+			var link strings.Builder
+			if _, err = io.Copy(&link, reader); err == nil {
+				err = makeSymlink(dest, target, link.String())
+			}
+		} else {
+			err = writeFile(dest, target, mode.Perm(), reader)
+		}
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTar(reader io.Reader, dest string) error {
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		target, err := safePath(dest, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = makeDirInside(dest, target)
+		case tar.TypeReg:
+			err = writeFile(dest, target, os.FileMode(header.Mode).Perm(), archive)
+		case tar.TypeSymlink:
+			err = makeSymlink(dest, target, header.Linkname)
+		case tar.TypeLink:
+			var source string
+			if source, err = safePath(dest, header.Linkname); err == nil {
+				err = makeHardlink(dest, target, source)
+			}
+		} // others like devices are skipped
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// join the name to dest, refusing names that end up outside of it (zip slip)
+func safePath(dest, name string) (string, error) {
+	path := filepath.Join(dest, name)
+	if !inside(dest, path) {
+		return "", fmt.Errorf("Unsafe path in archive: '%s'", name)
+	}
+	return path, nil
+}
+
+func inside(dest, path string) bool {
+	rel, err := filepath.Rel(dest, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// the path should not lead outside through the links already extracted
+func checkResolved(dest, path string) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	} else if !inside(dest, resolved) {
+		return fmt.Errorf("Unsafe link in archive at '%s'", path)
+	}
+	return nil
+}
+
+// make the dir after checking that what exists of it is inside dest
+func makeDirInside(dest, dir string) error {
+	existing := dir
+	for existing != dest {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	if err := checkResolved(dest, existing); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return checkResolved(dest, dir)
+}
+
+// remove an existing file at the path to replace it, but not write through a link
+func clearPath(path string) error {
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if stat.Mode()&os.ModeSymlink != 0 || stat.IsDir() {
+		return fmt.Errorf("Refusing to replace '%s' from archive", path)
+	}
+	return os.Remove(path)
+}
+
+// links can also point outside
+func makeSymlink(dest, path, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("Unsafe link in archive: '%s'", target)
+	}
+	dir := filepath.Dir(path)
+	if err := makeDirInside(dest, dir); err != nil {
+		return err
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if !inside(dest, filepath.Join(realDir, target)) {
+		return fmt.Errorf("Unsafe link in archive: '%s'", target)
+	}
+	if err := clearPath(path); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, path); err != nil {
+		return err
+	}
+	// through the earlier links, like a/.. with a -> .
+	if _, err := os.Stat(path); err == nil {
+		if err := checkResolved(dest, path); err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+	return nil
+}
+
+func makeHardlink(dest, path, source string) error {
+	if err := checkResolved(dest, filepath.Dir(source)); err != nil {
+		return err
+	}
+	stat, err := os.Lstat(source)
+	if err != nil {
+		return err
+	} else if !stat.Mode().IsRegular() {
+		return fmt.Errorf("Unsafe hard link in archive to '%s'", source)
+	}
+	if err := makeDirInside(dest, filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := clearPath(path); err != nil {
+		return err
+	}
+	return os.Link(source, path)
+}
+
+// O_EXCL to not follow a link made in the meantime
+func writeFile(dest, path string, mode os.FileMode, content io.Reader) error {
+	if err := makeDirInside(dest, filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := clearPath(path); err != nil {
+		return err
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,158 @@
+// -{go fmt %f}
+
+package download
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const WEBHOOK_TIMEOUT = 30 * time.Second
+
+// Hook is run after a download is complete, in order with the others. It can
+// change Dir and Filename if it moves the file. Its error becomes a warning.
+type Hook func(down *Download) error
+
+// run the hooks, collecting their errors as warnings
+func (down *Download) runHooks() {
+	for _, hook := range down.Hooks {
+		if err := hook(down); err != nil {
+			down.Warnings = append(down.Warnings, err.Error())
+		}
+	}
+}
+
+// CommandHook runs a command with the download info in the environment as
+// DMAN_PATH, DMAN_DIR, DMAN_FILENAME, DMAN_URL, DMAN_SIZE and DMAN_ID
+func CommandHook(command string, args ...string) Hook {
+	return func(down *Download) error {
+		cmd := exec.Command(command, args...)
+		cmd.Env = append(os.Environ(),
+			"DMAN_PATH="+filepath.Join(down.Dir, down.Filename),
+			"DMAN_DIR="+down.Dir,
+			"DMAN_FILENAME="+down.Filename,
+			"DMAN_URL="+down.Url,
+			"DMAN_SIZE="+strconv.FormatInt(down.Length, 10),
+			"DMAN_ID="+strconv.Itoa(down.Id),
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("Command '%s' failed: %v %s", command, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+}
+
+type MoveRule struct {
+	Pattern string `json:"pattern"` // as in filepath.Match, on the filename
+	Dir     string `json:"dir"`
+}
+
+// MoveHook moves the file to the dir of the first rule that matches its name
+func MoveHook(rules []MoveRule) Hook {
+	return func(down *Download) error {
+		for _, rule := range rules {
+			if matched, err := filepath.Match(rule.Pattern, down.Filename); err != nil {
+				return fmt.Errorf("Bad move pattern '%s': %v", rule.Pattern, err)
+			} else if !matched {
+				continue
+			}
+			if err := os.MkdirAll(rule.Dir, 0755); err != nil {
+				return err
+			}
+			name, err := reserveName(rule.Dir, down.Filename)
+			if err != nil {
+				return err
+			}
+			if err := moveFile(filepath.Join(down.Dir, down.Filename), filepath.Join(rule.Dir, name)); err != nil {
+				os.Remove(filepath.Join(rule.Dir, name))
+				return err
+			}
+			down.Dir, down.Filename = rule.Dir, name
+			return nil
+		}
+		return nil
+	}
+}
+
+// ChmodHook sets the permissions of the file
+func ChmodHook(mode os.FileMode) Hook {
+	return func(down *Download) error {
+		return os.Chmod(filepath.Join(down.Dir, down.Filename), mode)
+	}
+}
+
+// WebhookHook posts the download info as JSON to the url
+func WebhookHook(url string) Hook {
+	return func(down *Download) error {
+		info, err := json.Marshal(map[string]interface{}{
+			"id":       down.Id,
+			"url":      down.Url,
+			"dir":      down.Dir,
+			"filename": down.Filename,
+			"path":     filepath.Join(down.Dir, down.Filename),
+			"size":     down.Length,
+		})
+		if err != nil {
+			return err
+		}
+		client := http.Client{Timeout: WEBHOOK_TIMEOUT}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(info))
+		if err != nil {
+			return fmt.Errorf("Webhook failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("Webhook failed: %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// one hook in a config file, only one of the fields is set
+type HookConfig struct {
+	Run     []string   `json:"run,omitempty"` // command and its arguments
+	Move    []MoveRule `json:"move,omitempty"`
+	Chmod   string     `json:"chmod,omitempty"`   // octal, like "0644"
+	Webhook string     `json:"webhook,omitempty"` // url
+}
+
+// LoadHooks reads hooks from a JSON file with a list of HookConfig
+func LoadHooks(path string) ([]Hook, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []HookConfig
+	if err := json.Unmarshal(content, &configs); err != nil {
+		return nil, fmt.Errorf("Bad hooks file '%s': %v", path, err)
+	}
+	var hooks []Hook
+	for _, config := range configs {
+		switch {
+		case len(config.Run) > 0:
+			hooks = append(hooks, CommandHook(config.Run[0], config.Run[1:]...))
+		case len(config.Move) > 0:
+			hooks = append(hooks, MoveHook(config.Move))
+		case config.Chmod != "":
+			mode, err := strconv.ParseUint(config.Chmod, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Bad chmod mode '%s': %v", config.Chmod, err)
+			}
+			hooks = append(hooks, ChmodHook(os.FileMode(mode)))
+		case config.Webhook != "":
+			hooks = append(hooks, WebhookHook(config.Webhook))
+		default:
+			return nil, fmt.Errorf("Empty hook in '%s'", path)
+		}
+	}
+	return hooks, nil
+}
@@ -0,0 +1,67 @@
+// -{go fmt %f}
+
+package download
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const LIMIT_SLICES = 10 // max reads per second per connection when limited, to keep sleeps short
+
+// shared by the jobs of a download to keep the total speed under the limit
+type limiter struct {
+	mutex sync.Mutex
+	rate  int64     // bytes per second, 0 for unlimited
+	next  time.Time // when the next byte is allowed
+}
+
+func (lim *limiter) setRate(rate int64) {
+	lim.mutex.Lock()
+	defer lim.mutex.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	lim.rate = rate
+	lim.next = time.Time{}
+}
+
+func (lim *limiter) getRate() int64 {
+	lim.mutex.Lock()
+	defer lim.mutex.Unlock()
+	return lim.rate
+}
+
+// waits until n bytes can be read, may allow less than n
+func (lim *limiter) take(n int) int {
+	lim.mutex.Lock()
+	if lim.rate == 0 {
+		lim.mutex.Unlock()
+		return n
+	}
+	if max := int(lim.rate / LIMIT_SLICES); n > max {
+		n = max
+		if n < 1 {
+			n = 1
+		}
+	}
+	now := time.Now()
+	if lim.next.Before(now) { // don't save up unused time
+		lim.next = now
+	}
+	wait := lim.next.Sub(now)
+	lim.next = lim.next.Add(time.Duration(int64(n) * int64(time.Second) / lim.rate))
+	lim.mutex.Unlock()
+	time.Sleep(wait)
+	return n
+}
+
+type limitedReader struct {
+	reader io.Reader
+	lim    *limiter
+}
+
+func (r limitedReader) Read(p []byte) (int, error) {
+	return r.reader.Read(p[:r.lim.take(len(p))])
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+// -{go fmt %f}
+
+package download
+
+import (
+	"os"
+	"syscall"
+)
+
+// lock the file exclusively without waiting, ActiveError if held elsewhere
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ActiveError
+	}
+	return err
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
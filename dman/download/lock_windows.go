@@ -0,0 +1,40 @@
+// -{go fmt %f}
+
+package download
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	LOCKFILE_FAIL_IMMEDIATELY = 1
+	LOCKFILE_EXCLUSIVE_LOCK   = 2
+	ERROR_LOCK_VIOLATION      = syscall.Errno(33)
+)
+
+var (
+	lockFileEx   = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+	unlockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("UnlockFileEx")
+)
+
+// lock the first byte exclusively without waiting, ActiveError if held elsewhere
+func lockFile(file *os.File) error {
+	var overlapped syscall.Overlapped
+	ok, _, err := lockFileEx.Call(file.Fd(), LOCKFILE_EXCLUSIVE_LOCK|LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if ok != 0 {
+		return nil
+	} else if err == ERROR_LOCK_VIOLATION {
+		return ActiveError
+	}
+	return err
+}
+
+func unlockFile(file *os.File) error {
+	var overlapped syscall.Overlapped
+	if ok, _, err := unlockFileEx.Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped))); ok == 0 {
+		return err
+	}
+	return nil
+}
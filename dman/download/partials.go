@@ -0,0 +1,220 @@
+// -{go fmt %f}
+
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Partial is an unfinished download, from its progress file
+type Partial struct {
+	Progress
+	ProgressFile string
+	Dir          string    // where the file will be
+	Written      int64     // downloaded so far
+	Length       int64     // -1 if unknown
+	Modified     time.Time // the last change to it or its parts
+}
+
+// Stray is a part file left without its progress file, or an unreadable
+// progress file, that can only be removed
+type Stray struct {
+	Path     string
+	Size     int64
+	Modified time.Time
+}
+
+// Remove deletes the file, and the part dir if it becomes empty
+func (stray Stray) Remove() error {
+	if err := os.Remove(stray.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(filepath.Dir(stray.Path)) // only if empty
+	return nil
+}
+
+// Percent gives the downloaded percentage, -1 if the length is unknown
+func (partial Partial) Percent() float64 {
+	if partial.Length < 0 {
+		return -1
+	} else if partial.Length == 0 {
+		return 100
+	}
+	return float64(partial.Written) / float64(partial.Length) * 100
+}
+
+func (partial Partial) partFileName(offset int64) string {
+	return filepath.Join(partial.Dir, PART_DIR_NAME, fmt.Sprintf("%s.%d.%d", partial.Filename, partial.Id, offset))
+}
+
+// ReadPartial reads the progress file and the sizes of the parts
+func ReadPartial(progressFile string) (Partial, error) {
+	partial := Partial{
+		Progress:     Progress{Resumable: true}, // for those saved without it
+		ProgressFile: progressFile,
+		Dir:          filepath.Dir(filepath.Dir(progressFile)),
+	}
+	content, err := ioutil.ReadFile(progressFile)
+	if err != nil {
+		return partial, err
+	}
+	if stat, err := os.Stat(progressFile); err == nil {
+		partial.Modified = stat.ModTime()
+	}
+	if err := json.Unmarshal(content, &partial.Progress); err != nil {
+		return partial, fmt.Errorf("Bad progress file '%s': %v", progressFile, err)
+	}
+	for _, part := range partial.Parts {
+		if part["length"] < 0 { // unknown length
+			partial.Length = -1
+		} else if end := part["offset"] + part["length"]; partial.Length >= 0 && end > partial.Length {
+			partial.Length = end
+		}
+		if stat, err := os.Stat(partial.partFileName(part["offset"])); err == nil { // the file knows better
+			partial.Written += stat.Size()
+			if stat.ModTime().After(partial.Modified) {
+				partial.Modified = stat.ModTime()
+			}
+		}
+	}
+	return partial, nil
+}
+
+// ListPartials finds the unfinished downloads in the dir
+func ListPartials(dir string) ([]Partial, error) {
+	partials, _, err := scanPartDir(dir)
+	return partials, err
+}
+
+// ScanPartials finds the unfinished downloads and the stray files in the
+// dir, and in its subdirs if recursive
+func ScanPartials(root string, recursive bool) ([]Partial, []Stray, error) {
+	if !recursive {
+		return scanPartDir(root)
+	}
+	var partials []Partial
+	var strays []Stray
+	var lastErr error // the others are still listed
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			lastErr = err
+			return nil
+		} else if !info.IsDir() {
+			return nil
+		} else if info.Name() == PART_DIR_NAME && path != root {
+			return filepath.SkipDir // read with its parent
+		}
+		found, stray, err := scanPartDir(path)
+		if err != nil {
+			lastErr = err
+		}
+		partials, strays = append(partials, found...), append(strays, stray...)
+		return nil
+	})
+	if err != nil {
+		return partials, strays, err
+	}
+	return partials, strays, lastErr
+}
+
+// the partials and the strays in the part dir of the dir
+func scanPartDir(dir string) ([]Partial, []Stray, error) {
+	partDir := filepath.Join(dir, PART_DIR_NAME)
+	entries, err := ioutil.ReadDir(partDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	var partials []Partial
+	var strays []Stray
+	var lastErr error                  // the others are still listed
+	progressFiles := map[string]bool{} // the readable ones
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != PROG_FILE_EXT {
+			continue
+		}
+		path := filepath.Join(partDir, entry.Name())
+		if isActive(path) { // still downloading, not partial
+			progressFiles[entry.Name()] = true
+			continue
+		}
+		partial, err := ReadPartial(path)
+		if err != nil {
+			lastErr = err
+			strays = append(strays, Stray{path, entry.Size(), entry.ModTime()})
+			continue
+		}
+		partials = append(partials, partial)
+		progressFiles[entry.Name()] = true
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		// <filename>.<id>.<offset> or <filename>.<id>.lock
+		base := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		_, errOffset := strconv.ParseInt(strings.TrimPrefix(filepath.Ext(entry.Name()), "."), 10, 64)
+		_, errId := strconv.Atoi(strings.TrimPrefix(filepath.Ext(base), "."))
+		if filepath.Ext(entry.Name()) == LOCK_FILE_EXT {
+			errOffset = nil
+		}
+		progressFile := base + PROG_FILE_EXT
+		if errOffset == nil && errId == nil && !progressFiles[progressFile] && !isActive(filepath.Join(partDir, progressFile)) {
+			strays = append(strays, Stray{filepath.Join(partDir, entry.Name()), entry.Size(), entry.ModTime()})
+		}
+	}
+	return partials, strays, lastErr
+}
+
+// Remove deletes the progress file, the parts and the name reserved for it
+func (partial Partial) Remove() error {
+	_, err := RemovePartial(partial.Dir, partial.Filename, partial.Id)
+	return err
+}
+
+// RemovePartial deletes whichever of the progress file, the parts and the
+// empty file reserving the name of a download exist, giving their paths.
+// ActiveError if the download is running
+func RemovePartial(dir, filename string, id int) ([]string, error) {
+	partDir := filepath.Join(dir, PART_DIR_NAME)
+	if isActive(filepath.Join(partDir, fmt.Sprintf("%s.%d%s", filename, id, PROG_FILE_EXT))) {
+		return nil, ActiveError
+	}
+	entries, err := ioutil.ReadDir(partDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	prefix := fmt.Sprintf("%s.%d.", filename, id)
+	var removed []string
+	for _, entry := range entries {
+		suffix := strings.TrimPrefix(entry.Name(), prefix)
+		if suffix == entry.Name() {
+			continue
+		} else if _, err := strconv.ParseInt(suffix, 10, 64); err != nil && "."+suffix != PROG_FILE_EXT && "."+suffix != LOCK_FILE_EXT {
+			continue // another download's, with a longer name
+		}
+		path := filepath.Join(partDir, entry.Name())
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	os.Remove(partDir) // only if empty
+	path := filepath.Join(dir, filename)
+	if stat, err := os.Stat(path); err == nil && stat.Size() == 0 && len(removed) > 0 {
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
@@ -0,0 +1,113 @@
+// -{go fmt %f}
+
+package download
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const MAX_EXPANDED = 100000 // urls from a single pattern
+
+// like 001-250, a-z or 0-100:10
+var rangePattern = regexp.MustCompile(`^(\d+|[a-z]|[A-Z])-(\d+|[a-z]|[A-Z])(?::(\d+))?$`)
+
+// the values of a range inside [], nil if not a range, like an IPv6 host
+func expandRange(spec string) ([]string, error) {
+	match := rangePattern.FindStringSubmatch(spec)
+	if match == nil {
+		return nil, nil
+	}
+	step := 1
+	if match[3] != "" {
+		step, _ = strconv.Atoi(match[3])
+		if step < 1 {
+			return nil, fmt.Errorf("Bad step in [%s]", spec)
+		}
+	}
+	var values []string
+	if start, err := strconv.Atoi(match[1]); err == nil { // numbers
+		end, err := strconv.Atoi(match[2])
+		if err != nil || end < start {
+			return nil, fmt.Errorf("Bad range [%s]", spec)
+		}
+		width := 0
+		if len(match[1]) > 1 && match[1][0] == '0' { // zero padded
+			width = len(match[1])
+		}
+		for i := start; i <= end; i += step {
+			values = append(values, fmt.Sprintf("%0*d", width, i))
+		}
+		return values, nil
+	}
+	start, end := match[1][0], match[2][0]
+	if len(match[2]) > 1 || end < start || (start <= 'Z') != (end <= 'Z') {
+		return nil, fmt.Errorf("Bad range [%s]", spec)
+	}
+	for c := int(start); c <= int(end); c += step {
+		values = append(values, string(rune(c)))
+	}
+	return values, nil
+}
+
+// ExpandPattern expands ranges like [001-250], [a-z] or [0-100:10] (with a
+// step) and alternatives like {a,b,c} in the url, to all the combinations in
+// order. A url without them gives itself.
+func ExpandPattern(pattern string) ([]string, error) {
+	var parts [][]string // the options at each position
+	literal := ""
+	for i := 0; i < len(pattern); i++ {
+		var values []string
+		var end int
+		switch pattern[i] {
+		case '[':
+			if end = strings.IndexByte(pattern[i:], ']'); end > 0 {
+				var err error
+				if values, err = expandRange(pattern[i+1 : i+end]); err != nil {
+					return nil, err
+				}
+			}
+		case '{':
+			if end = strings.IndexByte(pattern[i:], '}'); end > 0 && strings.Contains(pattern[i:i+end], ",") {
+				values = strings.Split(pattern[i+1:i+end], ",")
+			}
+		}
+		if values == nil { // not a pattern
+			literal += pattern[i : i+1]
+			continue
+		}
+		parts = append(parts, []string{literal}, values)
+		literal = ""
+		i += end
+	}
+	urls := []string{""}
+	for _, values := range append(parts, []string{literal}) {
+		if len(urls)*len(values) > MAX_EXPANDED {
+			return nil, fmt.Errorf("Pattern gives more than %d URLs", MAX_EXPANDED)
+		}
+		var combined []string
+		for _, url := range urls {
+			for _, value := range values {
+				combined = append(combined, url+value)
+			}
+		}
+		urls = combined
+	}
+	return urls, nil
+}
+
+// NewBatch makes the downloads for the urls from a pattern, with ids
+// starting from firstId, to be started together
+func NewBatch(pattern string, maxConns int, firstId int, dir string) ([]*Download, error) {
+	urls, err := ExpandPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	downs := make([]*Download, len(urls))
+	for i, url := range urls {
+		downs[i] = New(url, maxConns, firstId+i, dir)
+	}
+	return downs, nil
+}
@@ -7,37 +7,126 @@ import (
 	"fmt"
 	"github.com/K1DV5/dman/dman/download"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
 var byteOrder = binary.LittleEndian // most likely
 
 type message struct {
-	// Incoming types: add, pause, pause-all, resume, info
-	// Outgoing types: add, pause, pause-all, resume, info, completed, error
-	Type     string            `json:"type"`
-	Url      string            `json:"url,omitempty"`
-	Id       int               `json:"id,omitempty"`
-	Filename string            `json:"filename,omitempty"`
-	Size     string            `json:"size,omitempty"`
-	Conns    int               `json:"conns,omitempty"`
-	Stats    []download.Status `json:"stats,omitempty"`
-	Info     bool              `json:"info,omitempty"`
-	Error    string            `json:"error,omitempty"`
-	Dir      string            `json:"dir,omitempty"`
+	// Incoming types: hello, add, pause, pause-all, info, set-conns, need-url, auth, remove, delete, open, list, partials
+	// Outgoing types: hello, reply, add, pause, info, need-url, auth-required, not-resumable, disk-full, skipped, completed, failed, error
+	Type       string            `json:"type"`
+	Request    int               `json:"request,omitempty"` // given by the extension, the same in the reply
+	Code       string            `json:"code,omitempty"`    // of the error in replies
+	Version    int               `json:"version,omitempty"` // of the protocol, in hello
+	Url        string            `json:"url,omitempty"`
+	Id         int               `json:"id,omitempty"`
+	Filename   string            `json:"filename,omitempty"`
+	Size       string            `json:"size,omitempty"`
+	Conns      int               `json:"conns,omitempty"`
+	Stats      []download.Status `json:"stats,omitempty"`
+	Info       bool              `json:"info,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Dir        string            `json:"dir,omitempty"`
+	Limit      int64             `json:"limit,omitempty"`       // bytes per second, negative to remove
+	Force      bool              `json:"force,omitempty"`       // pause even if not resumable
+	Conflict   string            `json:"conflict,omitempty"`    // policy if the file exists
+	Warning    string            `json:"warning,omitempty"`     // from the hooks, on completed
+	Extract    bool              `json:"extract,omitempty"`     // archives when completed
+	ExtractDir string            `json:"extract_dir,omitempty"` // beside the archive if empty
+	File       bool              `json:"file,omitempty"`        // delete the downloaded file as well
+	Deleted    []string          `json:"deleted,omitempty"`     // paths, in the reply to delete
+	Dirs       []string          `json:"dirs,omitempty"`        // to look for partials in, for list & partials
+	Recursive  bool              `json:"recursive,omitempty"`   // in the subdirs of the dirs as well, for partials
+	Downloads  []listItem        `json:"downloads,omitempty"`   // in the reply to list & partials
+	Strays     []strayItem       `json:"strays,omitempty"`      // in the reply to partials
+	More       bool              `json:"more,omitempty"`        // the rest of the reply follows
+	// the options of add, kept when resumed
+	Output   string            `json:"output,omitempty"` // the name to save as
+	Headers  map[string]string `json:"headers,omitempty"`
+	Cookies  map[string]string `json:"cookies,omitempty"`
+	Method   string            `json:"method,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Checksum string            `json:"checksum,omitempty"` // like sha-256=<hex>
+	Priority int               `json:"priority,omitempty"` // only kept and listed, all start at once
+	// the credentials of add and auth, empty in auth to give up
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"` // bearer
+	Realm    string `json:"realm,omitempty"` // of the server, in auth-required
 }
 
+// a download known to the host, in the reply to list
+type listItem struct {
+	Id        int     `json:"id"`
+	Url       string  `json:"url"`
+	Dir       string  `json:"dir"`
+	Filename  string  `json:"filename"`
+	State     string  `json:"state"`  // downloading or paused
+	Length    int64   `json:"length"` // -1 if unknown
+	Size      string  `json:"size"`
+	Written   string  `json:"written"`
+	Bytes     int64   `json:"bytes"`   // written
+	Percent   float64 `json:"percent"` // -1 if unknown
+	Resumable bool    `json:"resumable"`
+	Priority  int     `json:"priority,omitempty"`
+	Modified  int64   `json:"modified,omitempty"` // unix ms, of partials
+}
+
+// a part file without its progress file, in the reply to partials
+type strayItem struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"` // unix ms
+}
+
+const (
+	NOT_RESUMABLE_WARNING = "This download cannot be resumed, pausing it will lose the downloaded data."
+	URL_WAIT_TIME         = 2 * time.Minute // to wait for the extension to give a new url
+	AUTH_WAIT_TIME        = 5 * time.Minute // to wait for the user to give credentials
+	MAX_SEND_SIZE         = download.MB     // chrome's limit for messages from the host
+	MAX_GET_SIZE          = 4 * download.MB // ours, the messages are small
+	PROTOCOL_VERSION      = 1               // changed when the messages change
+	// error codes in replies
+	CODE_BAD_REQUEST   = "bad-request"   // unknown type or malformed
+	CODE_NOT_FOUND     = "not-found"     // no such download in progress
+	CODE_NOT_RESUMABLE = "not-resumable" // pausing loses the data, force it
+	CODE_VERSION       = "version"       // protocol version mismatch
+	CODE_TOO_LARGE     = "too-large"
+	CODE_FAILED        = "failed" // the error tells why
+)
+
+var sendMutex sync.Mutex // send() is called from many goroutines
+
+type frameSizeError struct {
+	size int
+}
+
+func (err frameSizeError) Error() string {
+	return fmt.Sprintf("Message of %s is too large", download.ReadableSize(int64(err.size)))
+}
+
+// read a whole frame, a frameSizeError if it is skipped for being too large
 func (msg *message) get() error {
 	length := make([]byte, 4)
-	_, err := os.Stdin.Read(length)
-	if err != nil {
+	if _, err := io.ReadFull(os.Stdin, length); err != nil {
 		return err
 	}
 	lengthNum := int(byteOrder.Uint32(length))
+	if lengthNum > MAX_GET_SIZE {
+		if _, err := io.CopyN(ioutil.Discard, os.Stdin, int64(lengthNum)); err != nil {
+			return err
+		}
+		return frameSizeError{lengthNum}
+	}
 	content := make([]byte, lengthNum)
-	if _, err := os.Stdin.Read(content); err != nil {
+	if _, err := io.ReadFull(os.Stdin, content); err != nil {
 		return err
 	}
 	if err := json.Unmarshal(content, msg); err != nil {
@@ -46,56 +135,198 @@ func (msg *message) get() error {
 	return nil
 }
 
+// send as one frame, one with too many stats or downloads is split into
+// several, with more set on all but the last
 func (msg message) send() error {
 	message, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
-	length := make([]byte, 4)
-	byteOrder.PutUint32(length, uint32(len(message)))
-	if _, err := os.Stdout.Write(append(length, message...)); err != nil {
+	if len(message) > MAX_SEND_SIZE {
+		if first, second, ok := msg.split(); ok {
+			if err := first.send(); err != nil {
+				return err
+			}
+			return second.send()
+		}
+		err := frameSizeError{len(message)}
+		msg.sendError(err)
+		return err
+	}
+	frame := make([]byte, 4, 4+len(message))
+	byteOrder.PutUint32(frame, uint32(len(message)))
+	sendMutex.Lock()
+	defer sendMutex.Unlock()
+	if _, err := os.Stdout.Write(append(frame, message...)); err != nil {
 		return err
 	}
 	return nil
 }
 
+// the halves of the list in the message, if there is one to split
+func (msg message) split() (message, message, bool) {
+	first, second := msg, msg
+	if half := len(msg.Stats) / 2; half > 0 {
+		first.Stats, second.Stats = msg.Stats[:half], msg.Stats[half:]
+	} else if half := len(msg.Downloads) / 2; half > 0 {
+		first.Downloads, second.Downloads = msg.Downloads[:half], msg.Downloads[half:]
+		first.Strays = nil
+	} else if half := len(msg.Strays) / 2; half > 0 {
+		first.Strays, second.Strays = msg.Strays[:half], msg.Strays[half:]
+		second.Downloads = nil
+	} else {
+		return msg, msg, false
+	}
+	first.More = true
+	return first, second, true
+}
+
+// tell the extension that this could not be sent
+func (msg message) sendError(err error) {
+	message{
+		Type:  "error",
+		Id:    msg.Id,
+		Error: fmt.Sprintf("Could not send '%s': %v", msg.Type, err),
+	}.send()
+}
+
+// the reply to this request, an error if the code is not empty
+func (msg message) reply(code, errMsg string) message {
+	return message{
+		Type:    "reply",
+		Request: msg.Request,
+		Id:      msg.Id,
+		Code:    code,
+		Error:   errMsg,
+	}
+}
+
 type completedInfo struct {
 	down *download.Download
 	err  error
 }
 
 type downloads struct {
-	collection map[int]*download.Download
-	addChan    chan message
-	message    chan message
-	insert     chan *download.Download
+	collection  map[int]*download.Download
+	addChan     chan message
+	message     chan message
+	insert      chan *download.Download
+	urlWaiting  map[int]chan string // downloads waiting for a new url
+	urlMutex    sync.Mutex
+	authWaiting map[int]chan message // downloads waiting for credentials
+	authMutex   sync.Mutex
+	hooks       []download.Hook         // run after each download
+	deleting    map[int]message         // delete requests waiting for the downloads to stop
+	stats       map[int]download.Status // the latest sent, for list
+	dirs        map[string]bool         // where downloads were saved, to look for partials
+}
+
+// ask the extension for a new url when the current one expires
+func (downs *downloads) resolveUrl(down *download.Download) func(int) (string, error) {
+	return func(status int) (string, error) {
+		urlChan := make(chan string, 1)
+		downs.urlMutex.Lock()
+		downs.urlWaiting[down.Id] = urlChan
+		downs.urlMutex.Unlock()
+		defer func() {
+			downs.urlMutex.Lock()
+			delete(downs.urlWaiting, down.Id)
+			downs.urlMutex.Unlock()
+		}()
+		message{
+			Type:  "need-url",
+			Id:    down.Id,
+			Url:   down.CurrentUrl(),
+			Error: fmt.Sprintf("Server responded with status %d", status),
+		}.send()
+		select {
+		case url := <-urlChan:
+			return url, nil
+		case <-time.After(URL_WAIT_TIME):
+			return "", fmt.Errorf("Timed out waiting for a new URL")
+		}
+	}
+}
+
+// ask the extension for credentials when the server asks for them
+func (downs *downloads) askCredentials(down *download.Download) func(string) (download.Credentials, error) {
+	return func(realm string) (download.Credentials, error) {
+		authChan := make(chan message, 1)
+		downs.authMutex.Lock()
+		downs.authWaiting[down.Id] = authChan
+		downs.authMutex.Unlock()
+		defer func() {
+			downs.authMutex.Lock()
+			delete(downs.authWaiting, down.Id)
+			downs.authMutex.Unlock()
+		}()
+		message{
+			Type:  "auth-required",
+			Id:    down.Id,
+			Url:   down.CurrentUrl(),
+			Realm: realm,
+		}.send()
+		select {
+		case msg := <-authChan:
+			return download.Credentials{User: msg.User, Password: msg.Password, Token: msg.Token}, nil
+		case <-time.After(AUTH_WAIT_TIME):
+			return download.Credentials{}, fmt.Errorf("Timed out waiting for credentials")
+		}
+	}
 }
 
 func (downs *downloads) addDownload() {
 	for info := range downs.addChan {
-		down := download.New(info.Url, info.Conns, info.Id, info.Dir)
-		msg := message{
-			Type: "add",
-			Id:   info.Id,
+		opts := download.Options{
+			Header:   http.Header{},
+			Cookies:  info.Cookies,
+			Method:   info.Method,
+			Body:     info.Body,
+			Checksum: info.Checksum,
+			Limit:    info.Limit,
+			Priority: info.Priority,
+			Conflict: download.Conflict(info.Conflict),
+		}
+		for name, value := range info.Headers {
+			opts.Header.Set(name, value)
 		}
+		down := download.New(info.Url, info.Conns, info.Id, info.Dir, opts)
+		down.ResolveUrl = downs.resolveUrl(down)
+		down.Credentials = download.Credentials{User: info.User, Password: info.Password, Token: info.Token}
+		down.AskCredentials = downs.askCredentials(down)
+		down.Hooks = downs.hooks
+		down.Extract, down.ExtractDir = info.Extract, info.ExtractDir
 		var errMsg string
 		if info.Filename == "" { // new
 			// create dir if it doesn't exist
 			os.Mkdir(info.Dir, 666)
-			if err := down.Start(); err != nil { // set filename as well
-				errMsg = fmt.Sprintf("\rStart error: %s", err.Error())
+			if down.Filename = download.CleanFilename(info.Output); down.Filename == "" && info.Output != "" {
+				info.reply(CODE_BAD_REQUEST, fmt.Sprintf("Bad output name '%s'", info.Output)).send()
+				continue
+			}
+			if err := down.Start(); err == download.SkippedError {
+				info.reply("", "").send()
+				message{
+					Type:     "skipped",
+					Id:       info.Id,
+					Dir:      down.Dir,
+					Filename: down.Filename,
+				}.send()
+				continue
+			} else if err != nil { // set filename as well
+				errMsg = fmt.Sprintf("Start error: %s", err.Error())
 			}
 		} else { // resume
 			progressFile := filepath.Join(info.Dir, download.PART_DIR_NAME, fmt.Sprintf("%s.%d%s", info.Filename, info.Id, download.PROG_FILE_EXT))
 			if err := down.Resume(progressFile); err != nil { // set filename as well
-				errMsg = fmt.Sprintf("\rResume error: %s", err.Error())
+				errMsg = fmt.Sprintf("Resume error: %s", err.Error())
 			}
 		}
 		if errMsg == "" {
+			info.reply("", "").send()
 			downs.insert <- down
 		} else {
-			msg.Error = errMsg
-			msg.send()
+			info.reply(CODE_FAILED, errMsg).send()
 		}
 	}
 }
@@ -111,6 +342,7 @@ func (downs *downloads) sendInfo() bool {
 		case stat, ok := <-down.Status:
 			if ok {
 				stats = append(stats, stat)
+				downs.stats[down.Id] = stat
 			}
 		default:
 			continue
@@ -131,13 +363,18 @@ func (downs *downloads) listen() {
 	for {
 		var msg message
 		if err := msg.get(); err != nil {
-			if err == io.EOF { // shutdown
+			if err == io.EOF || err == io.ErrUnexpectedEOF { // shutdown
 				close(downs.message)
 				<-kill
 				return
 			}
+			code := CODE_BAD_REQUEST
+			if _, ok := err.(frameSizeError); ok {
+				code = CODE_TOO_LARGE
+			}
 			message{
 				Type:  "error",
+				Code:  code,
 				Error: err.Error(),
 			}.send()
 			continue
@@ -146,69 +383,233 @@ func (downs *downloads) listen() {
 	}
 }
 
+// handle the message, replying to it exactly once
 func (downs *downloads) handleMsg(msg message) {
 	switch msg.Type {
+	case "hello":
+		reply := msg.reply("", "")
+		if msg.Version != PROTOCOL_VERSION {
+			reply = msg.reply(CODE_VERSION, fmt.Sprintf("Protocol version %d is not supported, dman uses %d", msg.Version, PROTOCOL_VERSION))
+		}
+		reply.Version = PROTOCOL_VERSION
+		reply.send()
 	case "pause":
 		down := downs.collection[msg.Id]
 		if down == nil {
-			message{
-				Type:  "pause",
-				Id:    msg.Id,
-				Error: "Download not in progress.",
-			}.send()
+			msg.reply(CODE_NOT_FOUND, "Download not in progress.").send()
+		} else if !down.Resumable && !msg.Force {
+			msg.reply(CODE_NOT_RESUMABLE, NOT_RESUMABLE_WARNING).send()
 		} else {
-			downs.collection[msg.Id].Stop <- os.Interrupt
+			down.Pause()
+			msg.reply("", "").send() // paused when the pause message comes
+		}
+	case "set-conns":
+		down := downs.collection[msg.Id]
+		if down == nil {
+			msg.reply(CODE_NOT_FOUND, "Download not in progress.").send()
+			return
+		}
+		if msg.Conns > 0 {
+			down.SetMaxConns(msg.Conns)
+		}
+		if msg.Limit != 0 {
+			down.SetLimit(msg.Limit) // negative becomes unlimited
+		}
+		reply := msg.reply("", "")
+		reply.Conns = down.MaxConns()
+		reply.Limit = down.Limit()
+		reply.send()
+	case "need-url":
+		downs.urlMutex.Lock()
+		urlChan := downs.urlWaiting[msg.Id]
+		downs.urlMutex.Unlock()
+		if urlChan == nil {
+			msg.reply(CODE_NOT_FOUND, "Download not waiting for a URL.").send()
+			return
+		}
+		select {
+		case urlChan <- msg.Url:
+		default: // already given
+		}
+		msg.reply("", "").send()
+	case "auth":
+		downs.authMutex.Lock()
+		authChan := downs.authWaiting[msg.Id]
+		downs.authMutex.Unlock()
+		if authChan == nil {
+			msg.reply(CODE_NOT_FOUND, "Download not waiting for credentials.").send()
+			return
+		}
+		select {
+		case authChan <- msg:
+		default: // already given
+		}
+		msg.reply("", "").send()
+	case "remove", "delete":
+		if msg.Type == "remove" { // only the partial
+			msg.File = false
 		}
-	case "remove":
-		go downs.remove(msg)
+		if _, ok := downs.deleting[msg.Id]; ok {
+			msg.reply(CODE_FAILED, "Download already being deleted.").send()
+			return
+		} else if down := downs.collection[msg.Id]; down != nil {
+			downs.deleting[msg.Id] = msg // deleted once stopped
+			down.Pause()                 // may have just ended, told when completed
+			return
+		}
+		go downs.delete(msg)
 	case "add":
-		downs.addChan <- msg
+		downs.addChan <- msg // replied once started
 	case "pause-all":
+		var unresumable int
 		for _, down := range downs.collection {
-			down.Stop <- os.Interrupt
+			if !down.Resumable && !msg.Force {
+				message{
+					Type:  "not-resumable",
+					Id:    down.Id,
+					Error: NOT_RESUMABLE_WARNING,
+				}.send()
+				unresumable++
+				continue
+			}
+			down.Pause()
+		}
+		if unresumable > 0 {
+			msg.reply(CODE_NOT_RESUMABLE, fmt.Sprintf("%d downloads cannot be resumed, not paused.", unresumable)).send()
+		} else {
+			msg.reply("", "").send()
 		}
+	case "list":
+		dirs := append([]string{}, msg.Dirs...)
+		for dir := range downs.dirs {
+			dirs = append(dirs, dir)
+		}
+		go downs.list(msg, downs.active(), dirs)
+	case "partials":
+		go downs.partials(msg, downs.active())
 	case "open":
 		go startFile(filepath.Join(msg.Dir, msg.Filename)) // platform dependent
+		msg.reply("", "").send()
 	default:
-		message{
-			Type:  "error",
-			Error: "Message type not recognized",
-		}.send()
+		msg.reply(CODE_BAD_REQUEST, fmt.Sprintf("Message type '%s' not recognized", msg.Type)).send()
 	}
-
 }
 
-func (downs *downloads) remove(info message) {
-	f, err := os.Open(filepath.Join(info.Dir, download.PART_DIR_NAME, fmt.Sprintf("%s.%d%s", info.Filename, info.Id, download.PROG_FILE_EXT)))
-	if err != nil {
-		message{Type: "error", Error: err.Error()}.send()
-		return
-	}
-	var prog download.Progress
-	if err := json.NewDecoder(f).Decode(&prog); err != nil {
-		message{Type: "error", Error: err.Error()}.send()
-		return
-	}
-	if err := f.Close(); err != nil {
-		message{Type: "error", Error: err.Error()}.send()
-		return
+// the downloads in progress, for list & partials
+func (downs *downloads) active() []listItem {
+	var active []listItem
+	for _, down := range downs.collection {
+		item := listItem{
+			Id:        down.Id,
+			Url:       down.CurrentUrl(),
+			Dir:       down.Dir,
+			Filename:  down.Filename,
+			State:     "downloading",
+			Length:    down.Length,
+			Size:      "Unknown",
+			Resumable: down.Resumable,
+			Priority:  down.Priority,
+		}
+		if down.Length >= 0 {
+			item.Size = download.ReadableSize(down.Length)
+		} else {
+			item.Percent = -1
+		}
+		if stat, ok := downs.stats[down.Id]; ok { // only while info is on
+			item.Bytes, item.Percent = stat.Bytes, stat.Percent
+		}
+		item.Written = download.ReadableSize(item.Bytes)
+		active = append(active, item)
 	}
-	if err := os.Remove(f.Name()); err != nil {
-		message{Type: "error", Error: err.Error()}.send()
-		return
+	return active
+}
+
+// reply with the active downloads and the partials in the dirs
+func (downs *downloads) list(info message, active []listItem, dirs []string) {
+	reply := info.reply("", "")
+	reply.Downloads = active
+	partials, _ := scanPartials(dirs, false, active)
+	reply.Downloads = append(reply.Downloads, partials...)
+	reply.send()
+}
+
+// reply with the partials and the stray files in the dirs
+func (downs *downloads) partials(info message, active []listItem) {
+	reply := info.reply("", "")
+	reply.Downloads, reply.Strays = scanPartials(info.Dirs, info.Recursive, active)
+	reply.send()
+}
+
+// the partials in the dirs that are not active, and the strays
+func scanPartials(dirs []string, recursive bool, active []listItem) ([]listItem, []strayItem) {
+	var items []listItem
+	var strays []strayItem
+	scanned := map[string]bool{}
+	for _, dir := range dirs {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		if scanned[dir] {
+			continue
+		}
+		scanned[dir] = true
+		partials, found, _ := download.ScanPartials(dir, recursive) // the readable ones
+	partials:
+		for _, partial := range partials {
+			for _, item := range active { // its progress file is there too
+				if item.Id == partial.Id && item.Filename == partial.Filename && filepath.Clean(item.Dir) == partial.Dir {
+					continue partials
+				}
+			}
+			item := listItem{
+				Id:        partial.Id,
+				Url:       partial.Url,
+				Dir:       partial.Dir,
+				Filename:  partial.Filename,
+				State:     "paused",
+				Length:    partial.Length,
+				Size:      "Unknown",
+				Written:   download.ReadableSize(partial.Written),
+				Bytes:     partial.Written,
+				Percent:   partial.Percent(),
+				Resumable: partial.Resumable,
+				Priority:  partial.Options.Priority,
+				Modified:  partial.Modified.UnixNano() / int64(time.Millisecond),
+			}
+			if partial.Length >= 0 {
+				item.Size = download.ReadableSize(partial.Length)
+			}
+			items = append(items, item)
+		}
+		for _, stray := range found {
+			strays = append(strays, strayItem{stray.Path, stray.Size, stray.Modified.UnixNano() / int64(time.Millisecond)})
+		}
 	}
-	for _, part := range prog.Parts {
-		fname := filepath.Join(info.Dir, download.PART_DIR_NAME, fmt.Sprintf("%s.%d.%d", info.Filename, info.Id, part["offset"]))
-		if err = os.Remove(fname); err != nil {
-			message{Type: "error", Error: err.Error()}.send()
-			return
+	return items, strays
+}
+
+// delete the partial download and the file if asked, replying with the paths
+// deleted
+func (downs *downloads) delete(info message) {
+	deleted, err := download.RemovePartial(info.Dir, info.Filename, info.Id)
+	if path := filepath.Join(info.Dir, info.Filename); err == nil && info.File && info.Filename != "" {
+		if err = os.Remove(path); err == nil {
+			deleted = append(deleted, path)
+		} else if os.IsNotExist(err) {
+			err = nil
 		}
 	}
-	os.Remove(filepath.Join(info.Dir, download.PART_DIR_NAME))
+	reply := info.reply("", "")
+	if err != nil {
+		reply = info.reply(CODE_FAILED, err.Error())
+	}
+	reply.Deleted = deleted
+	reply.send()
 }
 
 func (downs *downloads) finishInsertDown(down *download.Download, completed chan completedInfo) {
 	downs.collection[down.Id] = down
+	downs.dirs[down.Dir] = true
 	go func() {
 		err := <-down.Err
 		completed <- completedInfo{down: down, err: err}
@@ -222,7 +623,7 @@ func (downs *downloads) finishInsertDown(down *download.Download, completed chan
 	message{
 		Type:     "add",
 		Id:       down.Id,
-		Url:      down.Url,
+		Url:      down.CurrentUrl(),
 		Dir:      down.Dir,
 		Filename: down.Filename,
 		Size:     size,
@@ -231,18 +632,42 @@ func (downs *downloads) finishInsertDown(down *download.Download, completed chan
 
 func (downs *downloads) handleCompleted(info completedInfo) {
 	delete(downs.collection, info.down.Id)
+	delete(downs.stats, info.down.Id)
+	if msg, ok := downs.deleting[info.down.Id]; ok { // the reply tells
+		delete(downs.deleting, info.down.Id)
+		msg.Dir, msg.Filename = info.down.Dir, info.down.Filename // may be changed by the hooks
+		// it may have completed before it could stop
+		if info.err == nil && msg.Type == "delete" { // the data is the file now
+			msg.File = true
+		} else if info.err == nil { // nothing partial to remove, keep the file
+			resultMessage(info).send()
+		}
+		go downs.delete(msg)
+		return
+	}
+	resultMessage(info).send()
+}
+
+// the message telling how the download ended
+func resultMessage(info completedInfo) message {
 	msg := message{Id: info.down.Id}
 	if info.err == nil {
 		msg.Type = "completed"
-		msg.Filename = info.down.Filename
+		msg.Filename = info.down.Filename // may be changed by the hooks
+		msg.Dir = info.down.Dir
 		msg.Size = download.ReadableSize(info.down.Length)
+		msg.Warning = strings.Join(info.down.Warnings, "\n")
 	} else if info.err == download.PausedError {
 		msg.Type = "pause"
+	} else if info.err == download.DiskFullError { // paused, can be resumed after freeing space
+		msg.Type = "disk-full"
+		msg.Dir = info.down.Dir
+		msg.Error = info.err.Error()
 	} else {
 		msg.Type = "failed"
 		msg.Error = info.err.Error()
 	}
-	msg.send()
+	return msg
 }
 
 func (downs *downloads) coordinate(kill chan bool) {
@@ -263,9 +688,7 @@ func (downs *downloads) coordinate(kill chan bool) {
 				}
 				stopping = true
 				for _, down := range downs.collection {
-					go func(down *download.Download) {
-						down.Stop <- os.Interrupt
-					}(down)
+					down.Pause()
 				}
 				timer.Reset(download.STAT_INTERVAL * 2)
 			} else if msg.Type == "info" {
@@ -273,6 +696,7 @@ func (downs *downloads) coordinate(kill chan bool) {
 				if sendingInfo {
 					timer.Reset(download.STAT_INTERVAL)
 				}
+				msg.reply("", "").send()
 			} else {
 				downs.handleMsg(msg)
 			}
@@ -302,10 +726,21 @@ func (downs *downloads) coordinate(kill chan bool) {
 
 func extension() {
 	downs := downloads{
-		addChan:    make(chan message, 10),
-		collection: map[int]*download.Download{},
-		message:    make(chan message),
-		insert:     make(chan *download.Download),
+		addChan:     make(chan message, 10),
+		collection:  map[int]*download.Download{},
+		message:     make(chan message),
+		insert:      make(chan *download.Download),
+		urlWaiting:  map[int]chan string{},
+		authWaiting: map[int]chan message{},
+		deleting:    map[int]message{},
+		stats:       map[int]download.Status{},
+		dirs:        map[string]bool{},
+	}
+	message{Type: "hello", Version: PROTOCOL_VERSION}.send() // for the extension to check
+	hooks, err := loadHooks()
+	if err != nil {
+		message{Type: "error", Code: CODE_FAILED, Error: err.Error()}.send()
 	}
+	downs.hooks = hooks
 	downs.listen()
 }
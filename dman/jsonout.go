@@ -0,0 +1,151 @@
+// -{go fmt %f}
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/K1DV5/dman/dman/download"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// messages for people, to stderr with --json to keep stdout for the lines
+var notices io.Writer = os.Stdout
+
+// a line of --json output
+type jsonEvent struct {
+	// start, progress, state, completed, skipped, paused, failed, summary
+	Event        string           `json:"event"`
+	Time         string           `json:"time"`
+	Id           int              `json:"id"`
+	Url          string           `json:"url,omitempty"`
+	Path         string           `json:"path,omitempty"`
+	Size         int64            `json:"size,omitempty"` // -1 if unknown
+	Resumable    bool             `json:"resumable,omitempty"`
+	State        string           `json:"state,omitempty"` // downloading, rebuilding, extracting
+	Status       *download.Status `json:"status,omitempty"`
+	Duration     float64          `json:"duration,omitempty"` // seconds
+	Sha256       string           `json:"sha256,omitempty"`
+	Error        string           `json:"error,omitempty"`
+	Warnings     []string         `json:"warnings,omitempty"`
+	ProgressFile string           `json:"progress_file,omitempty"` // to resume
+	Counts       map[string]int   `json:"counts,omitempty"`        // of the batch items by state
+}
+
+type jsonOutput struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	states  map[int]string // the last state of each download
+}
+
+func newJsonOutput() *jsonOutput {
+	notices = os.Stderr
+	return &jsonOutput{encoder: json.NewEncoder(os.Stdout), states: map[int]string{}}
+}
+
+func (out *jsonOutput) emit(event jsonEvent) {
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	event.Time = time.Now().Format(time.RFC3339)
+	out.encoder.Encode(event)
+}
+
+func (out *jsonOutput) started(d *download.Download) {
+	out.emit(jsonEvent{
+		Event:     "start",
+		Id:        d.Id,
+		Url:       d.CurrentUrl(),
+		Path:      filepath.Join(d.Dir, d.Filename),
+		Size:      d.Length,
+		Resumable: d.Resumable,
+	})
+}
+
+// a progress line, and a state line if it changed
+func (out *jsonOutput) progress(stat download.Status) {
+	state := "downloading"
+	if stat.Rebuilding {
+		state = "rebuilding"
+	} else if stat.Extracting {
+		state = "extracting"
+	}
+	out.mutex.Lock()
+	changed := out.states[stat.Id] != state
+	out.states[stat.Id] = state
+	out.mutex.Unlock()
+	if changed {
+		out.emit(jsonEvent{Event: "state", Id: stat.Id, State: state})
+	}
+	out.emit(jsonEvent{Event: "progress", Id: stat.Id, Status: &stat})
+}
+
+// the final line of a download, returns the exit status
+func (out *jsonOutput) result(d *download.Download, err error, duration time.Duration) int {
+	event := jsonEvent{
+		Id:       d.Id,
+		Url:      d.CurrentUrl(),
+		Size:     d.Length,
+		Duration: duration.Seconds(),
+		Warnings: d.Warnings,
+	}
+	if d.Filename != "" { // known
+		event.Path = filepath.Join(d.Dir, d.Filename)
+	}
+	status := EXIT_COMPLETED
+	switch err {
+	case nil:
+		event.Event = "completed"
+		event.Sha256, _ = fileSha256(event.Path)
+	case download.SkippedError:
+		event.Event = "skipped"
+	case download.PausedError, download.DiskFullError:
+		event.Event, event.Error, event.ProgressFile = "paused", err.Error(), d.ProgressFile()
+		status = EXIT_PAUSED
+	default:
+		event.Event, event.Error = "failed", err.Error()
+		if d.Filename != "" && fileExists(d.ProgressFile()) { // resumable
+			event.ProgressFile = d.ProgressFile()
+		}
+		status = EXIT_FAILED
+	}
+	out.emit(event)
+	return status
+}
+
+func fileSha256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// download a started file with json lines, returns the exit status
+func runSingleJSON(d *download.Download, out *jsonOutput) int {
+	begin := time.Now()
+	out.started(d)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	for {
+		select {
+		case stat := <-d.Status:
+			out.progress(stat)
+		case <-interrupt: // no confirmation, scripts mean it
+			d.Pause()
+		case err := <-d.Err:
+			return out.result(d, err, time.Since(begin))
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// -{go fmt %f}
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	NAME        = "com.k1dv5.dman"
+	DESCRIPTION = "Download manager"
+	FIREFOX_ID  = "dman@k1dv5.github.io" // in the extension's manifest
+)
+
+// how to register the native messaging host
+type setupOptions struct {
+	id        string // of the extension in chrome and the browsers based on it
+	firefoxId string // of the extension in firefox, not registered there if empty
+	system    bool   // for all users, in the system dirs
+}
+
+// the native messaging host manifest for the browsers based on chrome, or
+// for firefox, where the extensions are listed differently
+func hostManifest(path, id string, firefox bool) map[string]interface{} {
+	manifest := map[string]interface{}{
+		"name":        NAME,
+		"description": DESCRIPTION,
+		"path":        path,
+		"type":        "stdio",
+	}
+	if firefox {
+		manifest["allowed_extensions"] = []string{id}
+	} else {
+		manifest["allowed_origins"] = []string{fmt.Sprintf("chrome-extension://%s/", id)}
+	}
+	return manifest
+}
+
+// whether the args are from a browser starting the native host: chrome gives
+// the extension's origin (and a window handle on windows), firefox gives the
+// path of the manifest and the extension's id
+func browserLaunch(args []string) bool {
+	if len(args) == 0 {
+		return false
+	} else if strings.HasPrefix(args[0], "chrome-extension://") {
+		return true
+	} else if len(args) != 2 || filepath.Ext(args[0]) != ".json" {
+		return false
+	}
+	content, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return false
+	}
+	var manifest struct {
+		Name string `json:"name"`
+	}
+	return json.Unmarshal(content, &manifest) == nil && manifest.Name == NAME
+}
+
+func writeManifest(path string, manifest map[string]interface{}) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(manifest); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,60 @@
+// -{go fmt %f}
+
+package main
+
+import (
+	"fmt"
+	"github.com/K1DV5/dman/dman/download"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const MIRROR_DEPTH = 5 // levels of pages to follow by default
+
+// comma separated, empty ones removed
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// crawl the start url for the files, kept in their directory structure under
+// dir. continues the mirror if it was started before
+func loadMirror(start, dir string, crawler *download.Crawler) ([]*batchItem, string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	stateFile := hashedStateFile(dir, "mirror", start)
+	if items, err := loadState(stateFile); err == nil || !os.IsNotExist(err) {
+		return items, stateFile, err
+	}
+	fmt.Fprintf(notices, "Crawling '%s'...\n", start)
+	files, err := crawler.Crawl(start)
+	if err != nil {
+		return nil, "", err
+	}
+	fmt.Fprintf(notices, "Found %d files\n", len(files))
+	var items []*batchItem
+	for _, file := range files {
+		relPath := filepath.FromSlash(file.Path)
+		items = append(items, &batchItem{
+			Url: file.Url,
+			Dir: filepath.Join(dir, filepath.Dir(relPath)),
+			Out: filepath.Base(relPath),
+		})
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0755); err != nil {
+		return nil, "", err
+	}
+	// saved before downloading to continue without crawling again
+	if err := saveBatch(items, stateFile); err != nil {
+		return nil, "", err
+	}
+	return items, stateFile, nil
+}
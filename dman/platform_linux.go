@@ -2,13 +2,172 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
-func setup() {
+// where a browser looks for native messaging host manifests
+type browser struct {
+	name    string
+	profile string // relative to home, it's installed if this exists
+	user    string // relative to home
+	system  string // empty if it reads another browser's
+	firefox bool
 }
 
-func execCmd(cmd string, args []string) {
+var browsers = []browser{
+	{"Google Chrome", ".config/google-chrome", ".config/google-chrome/NativeMessagingHosts", "/etc/opt/chrome/native-messaging-hosts", false},
+	{"Chromium", ".config/chromium", ".config/chromium/NativeMessagingHosts", "/etc/chromium/native-messaging-hosts", false},
+	{"Brave", ".config/BraveSoftware/Brave-Browser", ".config/BraveSoftware/Brave-Browser/NativeMessagingHosts", "", false},
+	{"Vivaldi", ".config/vivaldi", ".config/vivaldi/NativeMessagingHosts", "", false},
+	{"Microsoft Edge", ".config/microsoft-edge", ".config/microsoft-edge/NativeMessagingHosts", "/etc/opt/edge/native-messaging-hosts", false},
+	{"Firefox", ".mozilla", ".mozilla/native-messaging-hosts", "/usr/lib/mozilla/native-messaging-hosts", true},
 }
 
+// the dirs to put the manifest in for the browser, the user's only if it's
+// installed
+func (browser browser) dirs(home string, system bool) []string {
+	var dirs []string
+	if _, err := os.Stat(filepath.Join(home, browser.profile)); err == nil {
+		dirs = append(dirs, filepath.Join(home, browser.user))
+	}
+	if system && browser.system != "" {
+		dirs = append(dirs, browser.system)
+	}
+	return dirs
+}
+
+func setup(opts setupOptions) error {
+	if opts.id == "" {
+		fmt.Print("Extension id: ")
+		fmt.Scanln(&opts.id)
+		if opts.id = strings.TrimSpace(opts.id); opts.id == "" {
+			return fmt.Errorf("No extension id given")
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil { // the browsers need the real path
+		return err
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	var registered int
+	for _, browser := range browsers {
+		id := opts.id
+		if browser.firefox {
+			if id = opts.firefoxId; id == "" {
+				continue
+			}
+		}
+		manifest := hostManifest(exe, id, browser.firefox)
+		for _, dir := range browser.dirs(home, opts.system) {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			path := filepath.Join(dir, NAME+".json")
+			if err := writeManifest(path, manifest); err != nil {
+				return err
+			}
+			fmt.Printf("Registered for %s in '%s'\n", browser.name, path)
+			registered++
+		}
+	}
+	if registered == 0 {
+		return fmt.Errorf("No supported browser found, use -system to register for all users")
+	}
+	fmt.Println("You can now reload the extension.")
+	return nil
+}
+
+func uninstall(opts setupOptions) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	var removed int
+	for _, browser := range browsers {
+		dirs := []string{filepath.Join(home, browser.user)}
+		if opts.system && browser.system != "" {
+			dirs = append(dirs, browser.system)
+		}
+		for _, dir := range dirs {
+			path := filepath.Join(dir, NAME+".json")
+			if err := os.Remove(path); err == nil {
+				fmt.Printf("Unregistered from %s in '%s'\n", browser.name, path)
+				removed++
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if removed == 0 {
+		fmt.Println("Not registered for any browser.")
+	}
+	return nil
+}
+
+func execCmd(cmd string, args []string) error {
+	return exec.Command(cmd, args...).Run()
+}
+
+// open with the default application
 func startFile(path string) {
+	execCmd("xdg-open", []string{path})
+}
+
+// read key presses without waiting for enter, returns a function to restore
+func rawInput() func() {
+	saved, err := stty("-g")
+	if err != nil { // not a terminal
+		return func() {}
+	}
+	if _, err := stty("cbreak", "-echo"); err != nil {
+		return func() {}
+	}
+	return func() {
+		stty(strings.TrimSpace(saved))
+	}
+}
+
+// hide what is typed, like passwords, returns a function to restore
+func noEcho() func() {
+	if _, err := stty("-echo"); err != nil { // not a terminal
+		return func() {}
+	}
+	return func() {
+		stty("echo")
+	}
+}
+
+// the width and height of the terminal, 80x24 if unknown
+func termSize() (int, int) {
+	size, err := stty("size")
+	if fields := strings.Fields(size); err == nil && len(fields) == 2 {
+		height, _ := strconv.Atoi(fields[0])
+		width, _ := strconv.Atoi(fields[1])
+		if width > 0 && height > 0 {
+			return width, height
+		}
+	}
+	return 80, 24
+}
+
+// escape sequences work already
+func ansiOutput() {
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
 }
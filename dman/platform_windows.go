@@ -4,62 +4,107 @@ package main
 import (
 	"os"
 	// "strings"
-	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"syscall"
+	"unsafe"
 )
 
 const (
-	BIN = "dman.exe"
-	NAME = "com.k1dv5.dman"
-	DESCRIPTION = "Download manager"
+	BIN            = "dman.exe"
 	MANIFEST_FNAME = "nmh-manifest.json"
+	// with allowed_extensions instead of allowed_origins
+	FIREFOX_MANIFEST_FNAME = "nmh-manifest-firefox.json"
+	// console modes
+	ENABLE_ECHO_INPUT                  = 0x4
+	ENABLE_LINE_INPUT                  = 0x2
+	ENABLE_VIRTUAL_TERMINAL_PROCESSING = 0x4 // of the output
 )
 
-func setup() error {
-	fmt.Println("Setting up dman...")
-	idBuf := make([]byte, 1)
-	fmt.Print("Extension id: ")
-	fmt.Scanln(&idBuf)
-	id := string(idBuf)
+var kernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+// where the browsers look for the manifest, under the registry hive
+var registryKeys = []struct {
+	key      string
+	manifest string
+	firefox  bool
+}{
+	{"\\Software\\Google\\Chrome\\NativeMessagingHosts\\" + NAME, MANIFEST_FNAME, false},
+	{"\\Software\\Mozilla\\NativeMessagingHosts\\" + NAME, FIREFOX_MANIFEST_FNAME, true},
+}
+
+// the registry hive for the user or for all users
+func registryRoot(opts setupOptions) string {
+	if opts.system {
+		return "HKLM"
+	}
+	return "HKCU"
+}
 
-	manifest := map[string]interface{}{
-		"name": NAME,
-		"description": DESCRIPTION,
-		"path": BIN,
-		"type": "stdio",
-		"allowed_origins": []string{
-			fmt.Sprintf("chrome-extension://%s/", id),
-		},
+func setup(opts setupOptions) error {
+	fmt.Println("Setting up dman...")
+	interactive := opts.id == ""
+	if interactive {
+		idBuf := make([]byte, 1)
+		fmt.Print("Extension id: ")
+		fmt.Scanln(&idBuf)
+		opts.id = string(idBuf)
 	}
 
 	rootPath, err := os.Executable()
 	if err != nil {
 		return err
 	}
-	manifestPath := filepath.Join(filepath.Dir(rootPath), MANIFEST_FNAME)
-	manifestFile, err := os.Create(manifestPath)
-	if err != nil {
-		return err
+	for _, registry := range registryKeys {
+		id := opts.id
+		if registry.firefox {
+			if id = opts.firefoxId; id == "" {
+				continue
+			}
+		}
+		manifestPath := filepath.Join(filepath.Dir(rootPath), registry.manifest)
+		if err := writeManifest(manifestPath, hostManifest(BIN, id, registry.firefox)); err != nil {
+			return err
+		}
+		if err := execCmd("REG", []string{
+			"ADD",
+			registryRoot(opts) + registry.key,
+			"/ve",
+			"/t",
+			"REG_SZ",
+			"/d",
+			manifestPath,
+			"/f",
+		}); err != nil {
+			return err
+		}
 	}
-	if err := json.NewEncoder(manifestFile).Encode(manifest); err != nil {
-		return err
+	fmt.Println("\nYou can now reload the extension.")
+	if interactive {
+		fmt.Println("Press [ENTER] to continue.")
+		os.Stdin.Read(make([]byte, 1))
 	}
+	return nil
+}
 
-	if err := execCmd("REG", []string{
-		"ADD",
-		"HKCU\\Software\\Google\\Chrome\\NativeMessagingHosts\\" + NAME,
-		"/ve",
-		"/t",
-		"REG_SZ",
-		"/d",
-		manifestPath,
-		"/f",
-	}); err != nil {
+func uninstall(opts setupOptions) error {
+	rootPath, err := os.Executable()
+	if err != nil {
 		return err
 	}
-	fmt.Println("\nYou can now reload the extension.\nPress [ENTER] to continue.")
-	os.Stdin.Read(make([]byte, 1))
+	for _, registry := range registryKeys {
+		if err := execCmd("REG", []string{
+			"DELETE",
+			registryRoot(opts) + registry.key,
+			"/f",
+		}); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(filepath.Dir(rootPath), registry.manifest)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	fmt.Println("Removed the native messaging host registration.")
 	return nil
 }
 
@@ -79,3 +124,58 @@ func execCmd(cmd string, args []string) error {
 func startFile(path string) {
 	execCmd("start", []string{path})
 }
+
+// read key presses without waiting for enter, returns a function to restore
+func rawInput() func() {
+	handle := syscall.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := syscall.GetConsoleMode(handle, &mode); err != nil { // not a console
+		return func() {}
+	}
+	setMode := kernel32.NewProc("SetConsoleMode")
+	setMode.Call(uintptr(handle), uintptr(mode&^(ENABLE_ECHO_INPUT|ENABLE_LINE_INPUT)))
+	return func() {
+		setMode.Call(uintptr(handle), uintptr(mode))
+	}
+}
+
+// hide what is typed, like passwords, returns a function to restore
+func noEcho() func() {
+	handle := syscall.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := syscall.GetConsoleMode(handle, &mode); err != nil { // not a console
+		return func() {}
+	}
+	setMode := kernel32.NewProc("SetConsoleMode")
+	setMode.Call(uintptr(handle), uintptr(mode&^ENABLE_ECHO_INPUT))
+	return func() {
+		setMode.Call(uintptr(handle), uintptr(mode))
+	}
+}
+
+type consoleInfo struct {
+	size, cursor [2]int16
+	attributes   uint16
+	window       [4]int16 // left, top, right, bottom
+	maxSize      [2]int16
+}
+
+// the width and height of the console window, 80x24 if unknown
+func termSize() (int, int) {
+	var info consoleInfo
+	getInfo := kernel32.NewProc("GetConsoleScreenBufferInfo")
+	if ok, _, _ := getInfo.Call(os.Stdout.Fd(), uintptr(unsafe.Pointer(&info))); ok == 0 {
+		return 80, 24
+	}
+	return int(info.window[2]-info.window[0]) + 1, int(info.window[3]-info.window[1]) + 1
+}
+
+// make the console understand escape sequences
+func ansiOutput() {
+	handle := syscall.Handle(os.Stdout.Fd())
+	var mode uint32
+	if err := syscall.GetConsoleMode(handle, &mode); err != nil {
+		return
+	}
+	kernel32.NewProc("SetConsoleMode").Call(uintptr(handle), uintptr(mode|ENABLE_VIRTUAL_TERMINAL_PROCESSING))
+}
@@ -0,0 +1,647 @@
+// -{go fmt %f}
+
+package main
+
+import (
+	"fmt"
+	"github.com/K1DV5/dman/dman/download"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// entry states, besides the item states
+	T_QUEUED   = "queued"
+	T_STARTING = "starting"
+	T_ACTIVE   = "downloading"
+	T_STOPPING = "stopping"
+	// per connection lines shown for the selected download
+	TUI_MAX_CONNS = 8
+	TUI_HELP      = "up/down select  p pause  r resume  a add  +/- connections  x remove  q quit"
+)
+
+// a download shown in the terminal ui
+type tuiEntry struct {
+	item     *batchItem
+	id       int
+	state    string
+	down     *download.Download // while active
+	stat     download.Status    // the latest while active
+	percent  float64            // -1 if unknown
+	length   int64              // -1 if unknown
+	removing bool               // remove the partial once stopped
+	confirm  bool               // warned that pausing loses the data
+}
+
+type tuiResult struct {
+	entry *tuiEntry
+	down  *download.Download
+	err   error
+}
+
+type tui struct {
+	entries  []*tuiEntry
+	selected int
+	jobs     int // active at once
+	opts     options
+	nextId   int
+	started  chan tuiResult
+	finished chan tuiResult
+	keys     chan string
+	// the line above the help, a notice or the url being typed
+	notice   string
+	typing   bool
+	typed    string
+	asking   *tuiEntry // to be removed if confirmed
+	quitting bool
+}
+
+// read key presses, the arrow keys as "up" and "down"
+func readKeys(keys chan string) {
+	defer close(keys)
+	buf := make([]byte, 256)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		for chunk := string(buf[:n]); chunk != ""; { // pasted text comes at once
+			key, size := "", 1
+			if strings.HasPrefix(chunk, "\x1b[") || strings.HasPrefix(chunk, "\x1bO") {
+				// escape sequence, ends with a letter or ~
+				size = strings.IndexFunc(chunk[2:], func(char rune) bool {
+					return char >= '@' && char <= '~'
+				}) + 3
+				if size == 2 { // cut
+					size = len(chunk)
+				}
+				switch chunk[size-1] {
+				case 'A':
+					key = "up"
+				case 'B':
+					key = "down"
+				}
+			} else if chunk[0] == '\x1b' {
+				key = "esc"
+			} else {
+				char, charSize := utf8.DecodeRuneInString(chunk)
+				key, size = string(char), charSize
+			}
+			chunk = chunk[size:]
+			if key != "" {
+				keys <- key
+			}
+		}
+	}
+}
+
+// queue a new download
+func (ui *tui) add(item *batchItem) {
+	ui.entries = append(ui.entries, &tuiEntry{item: item, id: ui.nextId, state: T_QUEUED, percent: -1, length: -1})
+	ui.nextId++
+}
+
+// the partial downloads in the dir, paused
+func (ui *tui) addPartials(dir string) error {
+	partials, err := download.ListPartials(dir)
+	for _, partial := range partials {
+		partialDir, _ := filepath.Abs(partial.Dir) // not joined to the dir again
+		ui.entries = append(ui.entries, &tuiEntry{
+			item:    &batchItem{Url: partial.Url, Dir: partialDir, Filename: partial.Filename},
+			id:      partial.Id,
+			state:   ITEM_PAUSED,
+			percent: partial.Percent(),
+			length:  partial.Length,
+		})
+		if partial.Id >= ui.nextId { // new ones after them
+			ui.nextId = partial.Id + 1
+		}
+	}
+	return err
+}
+
+func (ui *tui) count(states ...string) int {
+	var count int
+	for _, entry := range ui.entries {
+		for _, state := range states {
+			if entry.state == state {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// start the queued ones in order, as many as allowed
+func (ui *tui) startNext() {
+	running := ui.count(T_STARTING, T_ACTIVE, T_STOPPING)
+	for _, entry := range ui.entries {
+		if ui.quitting || running >= ui.jobs {
+			return
+		} else if entry.state != T_QUEUED {
+			continue
+		}
+		entry.state = T_STARTING
+		running++
+		go func(entry *tuiEntry, item batchItem) {
+			d, err := item.start(entry.id, ui.opts)
+			if err != nil {
+				ui.finished <- tuiResult{entry: entry, down: d, err: err}
+				return
+			}
+			ui.started <- tuiResult{entry: entry, down: d}
+			ui.finished <- tuiResult{entry: entry, down: d, err: <-d.Err}
+		}(entry, *entry.item)
+	}
+}
+
+func (ui *tui) stop(entry *tuiEntry) {
+	entry.state = T_STOPPING
+	entry.down.Pause() // may have just ended
+}
+
+func (ui *tui) handleStarted(result tuiResult) {
+	entry := result.entry
+	entry.item.Filename = result.down.Filename
+	entry.down, entry.length, entry.state = result.down, result.down.Length, T_ACTIVE
+	if ui.quitting || entry.removing {
+		ui.stop(entry)
+	}
+}
+
+func (ui *tui) handleFinished(result tuiResult) {
+	entry, d := result.entry, result.down
+	entry.down, entry.item.Error = nil, ""
+	switch result.err {
+	case nil:
+		entry.state, entry.percent = ITEM_DONE, 100
+		entry.item.Filename = d.Filename // may be changed by the hooks
+		if len(d.Warnings) > 0 {
+			ui.notice = "Warning: " + strings.Join(d.Warnings, ", ")
+		}
+	case download.SkippedError:
+		entry.state, entry.percent = ITEM_SKIPPED, 100
+		entry.item.Filename = d.Filename
+	case download.PausedError, download.DiskFullError:
+		entry.state = ITEM_PAUSED
+		if result.err == download.DiskFullError {
+			ui.notice = fmt.Sprintf("Disk full, paused '%s'", d.Filename)
+		}
+	case download.ChecksumError: // corrupt, download again next time
+		os.Remove(filepath.Join(d.Dir, d.Filename))
+		entry.state, entry.item.Filename, entry.item.Error = ITEM_FAILED, "", result.err.Error()
+	default:
+		entry.state, entry.item.Error = ITEM_FAILED, result.err.Error()
+	}
+	if entry.removing {
+		ui.remove(entry, d)
+	}
+}
+
+// remove the entry and its partial download, not the finished file
+func (ui *tui) remove(entry *tuiEntry, d *download.Download) {
+	if entry.state == ITEM_PAUSED || entry.state == ITEM_FAILED {
+		if d == nil {
+			d = ui.opts.newDownload(entry.item.Url, entry.id, entry.item.Dir)
+			d.Filename = entry.item.Filename
+		}
+		if partial, err := download.ReadPartial(d.ProgressFile()); err == nil {
+			if err := partial.Remove(); err != nil {
+				ui.notice = "Error: " + err.Error()
+			}
+		}
+	}
+	for i, other := range ui.entries {
+		if other == entry {
+			ui.entries = append(ui.entries[:i], ui.entries[i+1:]...)
+			break
+		}
+	}
+	if ui.selected >= len(ui.entries) && ui.selected > 0 {
+		ui.selected--
+	}
+}
+
+// the url being typed after 'a'
+func (ui *tui) handleTyping(key string) {
+	switch key {
+	case "\r", "\n":
+		ui.typing = false
+		url := strings.TrimSpace(ui.typed)
+		if url == "" {
+			return
+		}
+		urls, err := download.ExpandPattern(url)
+		if err != nil {
+			ui.notice = "Error: " + err.Error()
+			return
+		}
+		for _, url := range urls {
+			ui.add(&batchItem{Url: url})
+		}
+		ui.selected = len(ui.entries) - 1
+		ui.notice = fmt.Sprintf("Added %d to the queue", len(urls))
+	case "esc":
+		ui.typing = false
+	case "\x7f", "\b": // backspace
+		if typed := []rune(ui.typed); len(typed) > 0 {
+			ui.typed = string(typed[:len(typed)-1])
+		}
+	default:
+		if len(key) == 1 && key[0] < ' ' { // other control keys
+			return
+		}
+		ui.typed += key
+	}
+}
+
+func (ui *tui) handleKey(key string) {
+	if ui.typing {
+		ui.handleTyping(key)
+		return
+	} else if ui.asking != nil {
+		entry := ui.asking
+		ui.asking, ui.notice = nil, ""
+		if key != "y" && key != "Y" {
+			return
+		}
+		switch entry.state {
+		case T_ACTIVE:
+			ui.stop(entry)
+			fallthrough
+		case T_STARTING, T_STOPPING: // once stopped
+			entry.removing = true
+		default:
+			ui.remove(entry, nil)
+		}
+		return
+	}
+	ui.notice = ""
+	if key == "q" {
+		ui.quit()
+		return
+	} else if key == "a" {
+		ui.typing, ui.typed = true, ""
+		return
+	}
+	if len(ui.entries) == 0 {
+		return
+	}
+	entry := ui.entries[ui.selected]
+	switch key {
+	case "up", "k":
+		if ui.selected > 0 {
+			ui.selected--
+		}
+	case "down", "j":
+		if ui.selected < len(ui.entries)-1 {
+			ui.selected++
+		}
+	case "p":
+		if entry.state == T_QUEUED {
+			entry.state = ITEM_PAUSED
+		} else if entry.state != T_ACTIVE {
+			return
+		} else if !entry.down.Resumable && !entry.confirm {
+			ui.notice = "This download cannot be resumed, press p again to stop it anyway."
+			entry.confirm = true
+		} else {
+			ui.stop(entry)
+		}
+	case "r":
+		if entry.state == ITEM_PAUSED || entry.state == ITEM_FAILED {
+			entry.state = T_QUEUED
+		}
+	case "+", "=", "-", "_":
+		if entry.state != T_ACTIVE {
+			return
+		}
+		conns := entry.down.MaxConns() + 1
+		if key == "-" || key == "_" {
+			conns = entry.down.MaxConns() - 1
+		}
+		entry.down.SetMaxConns(conns)
+		ui.notice = fmt.Sprintf("Connections: %d", entry.down.MaxConns())
+	case "x":
+		if entry.state == ITEM_DONE || entry.state == ITEM_SKIPPED {
+			ui.remove(entry, nil) // only from the list
+			return
+		}
+		ui.asking = entry
+		ui.notice = fmt.Sprintf("Remove '%s' and its downloaded parts? [y/N]", entry.name())
+	}
+}
+
+// pause all and exit when they are stopped
+func (ui *tui) quit() {
+	ui.quitting = true
+	ui.notice = "Pausing..."
+	for _, entry := range ui.entries {
+		if entry.state == T_ACTIVE {
+			ui.stop(entry)
+		} else if entry.state == T_QUEUED {
+			entry.state = ITEM_PAUSED
+		}
+	}
+}
+
+func (entry *tuiEntry) name() string {
+	if entry.item.Filename != "" {
+		return entry.item.Filename
+	} else if entry.item.Out != "" {
+		return entry.item.Out
+	}
+	return entry.item.Url
+}
+
+// the latest stats of the active downloads, without blocking
+func (ui *tui) updateStats() {
+	for _, entry := range ui.entries {
+		if entry.down == nil {
+			continue
+		}
+		select {
+		case stat, ok := <-entry.down.Status:
+			if ok {
+				entry.stat, entry.percent = stat, stat.Percent
+			}
+		default:
+		}
+	}
+}
+
+// a bar of the fraction done, empty if negative (unknown)
+func progressBar(width int, fraction float64) string {
+	done := 0
+	if fraction > 0 {
+		done = int(fraction * float64(width))
+	}
+	if done > width {
+		done = width
+	}
+	return strings.Repeat("█", done) + strings.Repeat("░", width-done)
+}
+
+// a map of the file, with the parts still being downloaded by the
+// connections lighter
+func segmentBar(width int, length int64, segments []download.Segment) string {
+	if length <= 0 || width <= 0 {
+		return progressBar(width, -1)
+	}
+	cells := make([]int64, width) // remaining bytes in each
+	cellSize := float64(length) / float64(width)
+	for _, segment := range segments {
+		if segment.Length < 0 {
+			continue
+		}
+		start, end := segment.Offset+segment.Received, segment.Offset+segment.Length
+		for cell := int(float64(start) / cellSize); cell < width && float64(cell)*cellSize < float64(end); cell++ {
+			cellStart, cellEnd := int64(float64(cell)*cellSize), int64(float64(cell+1)*cellSize)
+			if start > cellStart {
+				cellStart = start
+			}
+			if end < cellEnd {
+				cellEnd = end
+			}
+			if cellEnd > cellStart {
+				cells[cell] += cellEnd - cellStart
+			}
+		}
+	}
+	var bar strings.Builder
+	for _, remaining := range cells {
+		if remaining == 0 {
+			bar.WriteString("█")
+		} else if float64(remaining) < cellSize/2 {
+			bar.WriteString("▓")
+		} else if float64(remaining) < cellSize {
+			bar.WriteString("▒")
+		} else {
+			bar.WriteString("░")
+		}
+	}
+	return bar.String()
+}
+
+// cut or pad to the width
+func fitWidth(line string, width int) string {
+	runes := []rune(line)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return line + strings.Repeat(" ", width-len(runes))
+}
+
+// the first line of an entry, the name and the numbers
+func (entry *tuiEntry) summary(width int) string {
+	percent, size := "?%", "?"
+	if entry.percent >= 0 {
+		percent = fmt.Sprintf("%.1f%%", entry.percent)
+	}
+	if entry.length >= 0 {
+		size = download.ReadableSize(entry.length)
+	}
+	info := fmt.Sprintf("%s  %6s of %s", entry.state, percent, size)
+	if entry.state == T_ACTIVE && entry.stat.Rebuilding {
+		info = fmt.Sprintf("rebuilding %.0f%%", entry.stat.Percent)
+	} else if entry.state == T_ACTIVE && entry.stat.Extracting {
+		info = fmt.Sprintf("extracting %.0f%%", entry.stat.Percent)
+	} else if entry.state == T_ACTIVE {
+		info += fmt.Sprintf("  %s  x%d  %s", entry.stat.Speed, entry.stat.Conns, entry.stat.Eta)
+	} else if entry.item.Error != "" {
+		info += "  " + entry.item.Error
+	}
+	nameWidth := width - len([]rune(info)) - 4
+	if nameWidth < 10 {
+		nameWidth = 10
+	}
+	return fitWidth(entry.name(), nameWidth) + "  " + info
+}
+
+// the lines of the screen
+func (ui *tui) render(width, height int) []string {
+	var rate int64
+	for _, entry := range ui.entries {
+		if entry.state == T_ACTIVE {
+			rate += entry.stat.Rate
+		}
+	}
+	dir, _ := filepath.Abs(ui.opts.dir)
+	lines := []string{
+		fmt.Sprintf(" dman  %d active, %d queued, %d paused, %d done  %s/s  in %s",
+			ui.count(T_STARTING, T_ACTIVE, T_STOPPING), ui.count(T_QUEUED), ui.count(ITEM_PAUSED),
+			ui.count(ITEM_DONE, ITEM_SKIPPED), download.ReadableSize(rate), dir),
+		"",
+	}
+	// details of the selected one, at the bottom
+	var details []string
+	if len(ui.entries) > 0 {
+		entry := ui.entries[ui.selected]
+		details = append(details, "", " "+entry.item.Url)
+		if entry.state == T_ACTIVE && !entry.stat.Rebuilding && !entry.stat.Extracting {
+			details = append(details, " map  "+segmentBar(width-7, entry.length, entry.stat.Segments))
+			for i, segment := range entry.stat.Segments {
+				if i == TUI_MAX_CONNS {
+					details = append(details, fmt.Sprintf(" ... %d more connections", len(entry.stat.Segments)-i))
+					break
+				}
+				fraction, remaining := float64(-1), "?"
+				if segment.Length > 0 {
+					fraction = float64(segment.Received) / float64(segment.Length)
+					remaining = download.ReadableSize(segment.Length - segment.Received)
+				}
+				info := fmt.Sprintf(" %10s left", remaining)
+				details = append(details, fmt.Sprintf(" #%-3d", i+1)+progressBar(width-6-len(info), fraction)+info)
+			}
+		}
+	}
+	footer := []string{"", " " + ui.notice, " " + TUI_HELP}
+	if ui.typing {
+		footer[1] = " URL: " + ui.typed + "_"
+	}
+	// the list, scrolled to show the selected
+	rows := (height - len(lines) - len(details) - len(footer)) / 2
+	if rows < 1 {
+		rows, details = 1, nil
+	}
+	first := 0
+	if ui.selected >= rows {
+		first = ui.selected - rows + 1
+	}
+	for i := first; i < len(ui.entries) && i < first+rows; i++ {
+		entry, marker := ui.entries[i], "  "
+		if i == ui.selected {
+			marker = "> "
+		}
+		lines = append(lines, marker+entry.summary(width-2))
+		fraction := entry.percent / 100
+		if entry.percent < 0 && entry.state != ITEM_DONE {
+			fraction = -1
+		}
+		lines = append(lines, "  "+progressBar(width-4, fraction))
+	}
+	if len(ui.entries) == 0 {
+		lines = append(lines, " No downloads, press a to add a URL.")
+	}
+	for len(lines) < height-len(details)-len(footer) {
+		lines = append(lines, "")
+	}
+	return append(append(lines, details...), footer...)
+}
+
+func (ui *tui) draw() {
+	width, height := termSize() // platform dependent
+	var screen strings.Builder
+	screen.WriteString("\x1b[H")
+	for i, line := range ui.render(width, height) {
+		if i >= height {
+			break
+		} else if i > 0 {
+			screen.WriteString("\r\n")
+		}
+		screen.WriteString(fitWidth(line, width-1))
+	}
+	screen.WriteString("\x1b[J")
+	os.Stdout.WriteString(screen.String())
+}
+
+// run until quit and the downloads are paused, returns the exit status
+func (ui *tui) run() int {
+	ansiOutput() // platform dependent
+	restore := rawInput()
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l") // alternate screen, no cursor
+	defer func() {
+		os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+		restore()
+	}()
+	go readKeys(ui.keys)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	ticker := time.NewTicker(download.STAT_INTERVAL)
+	defer ticker.Stop()
+	ui.startNext()
+	for {
+		ui.draw()
+		if ui.quitting && ui.count(T_STARTING, T_ACTIVE, T_STOPPING) == 0 {
+			break
+		}
+		select {
+		case key, ok := <-ui.keys:
+			if !ok { // no input
+				ui.keys = nil
+				continue
+			}
+			ui.handleKey(key)
+		case <-interrupt:
+			ui.quit()
+		case result := <-ui.started:
+			ui.handleStarted(result)
+		case result := <-ui.finished:
+			ui.handleFinished(result)
+		case <-ticker.C:
+			ui.updateStats()
+		}
+		ui.startNext()
+	}
+	if ui.count(ITEM_DONE, ITEM_SKIPPED) == len(ui.entries) {
+		return EXIT_COMPLETED
+	} else if ui.count(ITEM_FAILED) > 0 && ui.count(ITEM_PAUSED) == 0 {
+		return EXIT_FAILED
+	}
+	return EXIT_PAUSED
+}
+
+func cmdTui(args []string) int {
+	flags, opts := newFlags("tui", "tui [options] [url or pattern]...")
+	limit, jsonLines := optionFlags(flags, opts)
+	flags.StringVar(&opts.dir, "d", ".", "directory to save to and list the partial downloads of")
+	input := flags.String("i", "", "file with urls to queue, one per line")
+	jobs := flags.Int("j", BATCH_JOBS, "simultaneous downloads")
+	urls, err := parseFlags(flags, args)
+	if err != nil {
+		return EXIT_USAGE
+	} else if *jsonLines || *jobs < 1 || opts.conns < 0 {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+	if status := opts.finish(*limit, false); status != EXIT_COMPLETED {
+		return status
+	}
+	defer opts.storeCookies()
+	ui := tui{
+		jobs:     *jobs,
+		opts:     *opts,
+		started:  make(chan tuiResult),
+		finished: make(chan tuiResult),
+		keys:     make(chan string),
+	}
+	if err := ui.addPartials(opts.dir); err != nil {
+		ui.notice = "Error: " + err.Error()
+	}
+	var items []*batchItem
+	if *input != "" {
+		if items, err = readInput(*input); err != nil {
+			fmt.Fprintln(notices, "Error:", err)
+			return EXIT_FAILED
+		}
+	}
+	for _, pattern := range urls {
+		expanded, err := download.ExpandPattern(pattern)
+		if err != nil {
+			fmt.Fprintln(notices, "Error:", err)
+			return EXIT_USAGE
+		}
+		for _, url := range expanded {
+			items = append(items, &batchItem{Url: url})
+		}
+	}
+	for _, item := range items {
+		ui.add(item)
+	}
+	return ui.run()
+}
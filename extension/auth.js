@@ -0,0 +1,29 @@
+let {downloads} = chrome.extension.getBackgroundPage()
+let params = new URLSearchParams(location.search)
+let id = Number(params.get('id'))
+let answered = false
+
+document.getElementById('site').innerText = new URL(params.get('url')).host
+document.getElementById('realm').innerText = params.get('realm')
+
+function answer(credentials) {
+    if (!answered) {
+        answered = true
+        downloads.sendAuth(id, credentials)
+    }
+    window.close()
+}
+
+document.getElementById('auth').addEventListener('submit', event => {
+    event.preventDefault()
+    answer({
+        user: document.getElementById('user').value,
+        password: document.getElementById('password').value,
+        token: document.getElementById('token').value,
+    })
+})
+
+document.getElementById('cancel').addEventListener('click', () => answer({}))
+
+// closing the window gives up as well
+window.addEventListener('beforeunload', () => answer({}))
@@ -7,15 +7,20 @@ states = {
     urlPending: 3,
     rebuilding: 4,
     completed: 5,
+    extracting: 6,
 }
 // states indicating in progress
-const progStates = [states.downloading, states.rebuilding]
+const progStates = [states.downloading, states.rebuilding, states.extracting]
 // platform specific file path separator
 const pathSep = navigator.platform == 'Win32' ? '\\' : '/'
 // duration before clearing notifications, ns
 const notifyTimeout = 5000
+// of the messages with the native host, the same as in dman
+const protocolVersion = 1
 // remove bottom bar when starting a new download
-chrome.downloads.setShelfEnabled(false)
+if (chrome.downloads.setShelfEnabled) {  // not in firefox
+    chrome.downloads.setShelfEnabled(false)
+}
 
 // show alerts
 function notify(title, contextMessage, id, timeout) {
@@ -68,6 +73,8 @@ class Downloads {
         // settings
         this.settingsDefault = {
             conns: 1,
+            conflict: 'rename',
+            extract: false,
             categories: {
                 Compressed: ['zip', 'rar'],
                 Documents: ['pdf', 'mobi', 'epub'],
@@ -104,22 +111,33 @@ class Downloads {
             if (res.icons != undefined) {
                 this.icons = res.icons
             }
+            this.sync()
         })
 
         // add orders sent to core, expecting response
         this.pending = {}
+        // callbacks of the requests sent to core, by request id
+        this.requests = {}
+        this.lastRequest = 0
         // to change url
         this.urlPending = undefined
 
         this.updateBadge()
 
         const msgHandlers = {
+            hello: this.handleHello.bind(this),
+            reply: this.handleReply.bind(this),
             info: this.handleInfo.bind(this),
             add: this.handleAdd.bind(this),
             pause: this.handlePause.bind(this),
             completed: this.handleCompleted.bind(this),
             failed: this.handleFailed.bind(this),
+            'disk-full': this.handleDiskFull.bind(this),
+            skipped: this.handleSkipped.bind(this),
             'pause-all': this.handlePauseAll.bind(this),
+            'not-resumable': this.handleNotResumable.bind(this),
+            'need-url': this.handleNeedUrl.bind(this),
+            'auth-required': this.handleAuthRequired.bind(this),
             error: this.handleError.bind(this),
             default: message => {
                 notify('Error', 'Unknown message type: ' + message.type)
@@ -157,59 +175,178 @@ class Downloads {
         }
     }
 
-    add(browserId, url, dir, iconHash) {
+    // send a message to core, the callback gets the reply, errors are
+    // notified if not given
+    request(message, callback) {
+        message.request = ++this.lastRequest
+        this.requests[message.request] = callback || (reply => {
+            if (reply.error) {
+                notify('Error', reply.error, reply.id)
+            }
+        })
+        this.native.postMessage(message)
+    }
+
+    // take over the browser's download, with what the browser knows about it
+    add(item, dir, iconHash) {
         let id = Number(new Date().getTime().toString().slice(3, -2))
         this.pending[id] = {
-            browserId,
+            browserId: item.id,
+            origUrl: item.url,  // before redirects, to get a fresh url later
             icon: iconHash,
         }
-        // send to native
-        this.native.postMessage({
-            type: 'add',
-            id,
-            url,
-            dir,
-            conns: this.settings.conns,
+        let headers = {}
+        if (item.referrer) {
+            headers.Referer = item.referrer
+        }
+        chrome.cookies.getAll({ url: item.finalUrl }, browserCookies => {
+            let cookies = {}
+            for (let cookie of browserCookies || []) {
+                cookies[cookie.name] = cookie.value
+            }
+            // send to native
+            this.request({
+                type: 'add',
+                id,
+                url: item.finalUrl,
+                dir,
+                output: item.filename.slice(item.filename.lastIndexOf(pathSep) + 1),  // as named by the browser
+                headers,
+                cookies,
+                conns: this.settings.conns,
+                conflict: this.settings.conflict,
+                extract: this.settings.extract,
+            }, reply => {
+                if (reply.error) {
+                    this.handleAddFailed(reply)
+                }
+            })
         })
     }
 
     changeState(id, to) {
         let info = this.items[id]
-        if (info.state == states.rebuilding) return  // rebuilding
+        if (info.state == states.rebuilding || info.state == states.extracting) return  // finishing
         if (info.state == states.downloading) {  // downloading
             if (to != states.paused) return
-            // pause
-            this.native.postMessage({ id, type: 'pause', id })
-        } else if (to == null) {  // delete
-            this.native.postMessage({ id, type: 'delete', filename: info.filename, dir: info.dir })
+            // pause, forced if already warned that it cannot be resumed
+            this.request({ type: 'pause', id, force: info.unresumable }, reply => {
+                if (reply.code == 'not-resumable') {
+                    this.handleNotResumable(reply)
+                } else if (reply.error) {
+                    notify(reply.error, info.filename, id, notifyTimeout)
+                }
+            })
         } else {  // paused / failed
             if (to != states.downloading) return
             // resume
-            this.native.postMessage({
+            this.request({
                 id,
                 type: 'add',
                 url: info.url,
                 filename: info.filename,  // filename will be used to know if resuming
-                dir: info.dir
+                dir: info.dir,
+                extract: this.settings.extract,
+            }, reply => {
+                if (reply.error) {
+                    notify('Resume error', reply.error, id, notifyTimeout)
+                }
             })
         }
     }
 
+    // get what core has, the downloads may have changed while the browser was
+    // closed or the extension was reloaded
+    sync() {
+        let dirs = [...new Set(Object.values(this.items).map(d => d.dir).filter(d => d))]
+        let found = []
+        this.request({ type: 'list', dirs }, reply => {
+            if (reply.error) {
+                notify('Error', reply.error)
+                return
+            }
+            found.push(...(reply.downloads || []))
+            if (!reply.more) {
+                this.reconcile(found)
+            }
+        })
+    }
+
+    reconcile(found) {
+        let popup = chrome.extension.getViews({ type: 'popup' })[0]
+        let byId = {}
+        for (let down of found) {
+            let item = this.items[down.id]
+            if (item != undefined && (item.filename != down.filename || item.dir != down.dir || item.state == states.completed)) {
+                continue  // a different one with the same id
+            }
+            byId[down.id] = down
+            let isNew = item == undefined
+            if (isNew) {  // from elsewhere, e.g. the command line
+                item = this.items[down.id] = {
+                    url: down.url,
+                    dir: down.dir,
+                    filename: down.filename,
+                    conns: 0,
+                    speed: '...',
+                    eta: '...',
+                    date: Date.now(),
+                }
+            }
+            if (down.state == 'paused') {
+                item.state = states.paused
+            } else if (!progStates.includes(item.state)) {
+                item.state = states.downloading
+            }
+            item.size = down.size
+            item.written = down.written
+            item.percent = down.percent
+            if (!down.resumable) {
+                item.unresumable = true
+            }
+            if (isNew) {
+                popup?.add(down.id, item)  // popup.addRow
+            } else {
+                popup?.update(down.id)  // popup.update
+            }
+        }
+        for (let [id, item] of Object.entries(this.items)) {
+            if (progStates.includes(item.state) && byId[id] == undefined) {  // core stopped without telling
+                item.state = states.failed
+                popup?.update(id)  // popup.update
+            }
+        }
+        if (popup && found.some(d => d.state == 'downloading')) {
+            this.switchUpdates(true)
+        }
+        chrome.storage.local.set({ downloads: this.items })
+        this.updateBadge()
+    }
+
+    // change connections and speed limit (bytes/s, negative to remove) while downloading
+    setConns(id, conns, limit) {
+        this.request({ type: 'set-conns', id, conns, limit }, reply => {
+            if (reply.error) {
+                notify(reply.error, this.items[id]?.filename, id, notifyTimeout)
+            }
+        })
+    }
+
     pauseAll() {
-        this.native.postMessage({ type: 'pause-all' })
+        this.request({ type: 'pause-all' }, () => {})  // the unresumable ones are notified one by one
     }
 
     switchUpdates(to) {
-        this.native.postMessage({ type: 'info', info: to })
+        this.request({ type: 'info', info: to }, () => {})
     }
 
     openFile(id) {
         let down = this.items[id]
-        this.native.postMessage({ type: 'open', filename: down.filename, dir: down.dir })
+        this.request({ type: 'open', filename: down.filename, dir: down.dir })
     }
 
     openDir(id) {
-        this.native.postMessage({ type: 'open', dir: this.items[id]?.dir })
+        this.request({ type: 'open', dir: this.items[id]?.dir })
     }
 
     remove(id) {
@@ -221,7 +358,7 @@ class Downloads {
             this.urlPending = undefined
         }
         if (download.state != states.completed) {
-            this.native.postMessage({ id, type: 'remove', dir: download.dir, filename: download.filename })
+            this.request({ id, type: 'remove', dir: download.dir, filename: download.filename })
         }
         this.addIconKey(this.items[id].icon, -1)
         delete this.items[id]
@@ -229,6 +366,28 @@ class Downloads {
         return true
     }
 
+    // delete the download with its data, stopping it if in progress, and the
+    // file if completed
+    delete(id) {
+        let download = this.items[id]
+        if (download == undefined || download.state == states.rebuilding || download.state == states.extracting) {  // finishing
+            return false
+        }
+        let message = { id, type: 'delete', dir: download.dir, filename: download.filename, file: download.state == states.completed }
+        this.request(message, reply => {
+            if (reply.error) {
+                notify('Deleting failed', reply.error, id, notifyTimeout)
+                return
+            }
+            this.addIconKey(download.icon, -1)
+            delete this.items[id]
+            chrome.storage.local.set({ downloads: this.items, icons: this.icons })
+            this.updateBadge()
+            notify('Deleted', (reply.deleted || []).length + ' files of ' + download.filename, id, notifyTimeout)
+        })
+        return true
+    }
+
     updateBadge() {
         let downs = Object.values(this.items).filter(d => progStates.includes(d.state)).length
         chrome.browserAction.setBadgeText({ text: String(downs || '') })
@@ -242,6 +401,9 @@ class Downloads {
             if (stat.rebuilding) {
                 download.state = states.rebuilding
                 continue
+            } else if (stat.extracting) {
+                download.state = states.extracting
+                continue
             }
             download.written = stat.written
             download.conns = stat.conns || 0
@@ -254,25 +416,46 @@ class Downloads {
         }
     }
 
-    handleAdd(message) {
-        if (message.error) {
-            if (this.pending[message.id] != undefined) {
-                chrome.downloads.search({ id: this.pending[message.id].id }, items => {
-                    this.addIconKey(this.pending[message.id].icon, -1)
-                    delete this.pending[message.id]
-                    chrome.downloads.resume(items[0].id)
-                    notify("Adding download failed", message.error + "\n\nContinuing in Downloads...", message.id, notifyTimeout)
-                })
-            } else {
-                notify("Adding download failed", message.error, message.id, notifyTimeout)
-            }
-            return
+    // the first message from core
+    handleHello(message) {
+        if (message.version != protocolVersion) {
+            notify('Version mismatch', `dman uses protocol version ${message.version}, this extension ${protocolVersion}. Update the older one.`)
+        }
+    }
+
+    handleReply(message) {
+        let callback = this.requests[message.request]
+        if (!message.more) {  // the last part
+            delete this.requests[message.request]
+        }
+        if (callback) {
+            callback(message)
+        } else if (message.error) {
+            notify('Error', message.error, message.id)
+        }
+    }
+
+    // continue in the browser
+    handleAddFailed(message) {
+        if (this.pending[message.id] != undefined) {
+            chrome.downloads.search({ id: this.pending[message.id].browserId }, items => {
+                this.addIconKey(this.pending[message.id].icon, -1)
+                delete this.pending[message.id]
+                chrome.downloads.resume(items[0].id)
+                notify("Adding download failed", message.error + "\n\nContinuing in Downloads...", message.id, notifyTimeout)
+            })
+        } else {
+            notify("Adding download failed", message.error, message.id, notifyTimeout)
         }
+    }
+
+    handleAdd(message) {
         let popup = chrome.extension.getViews({ type: 'popup' })[0]
         if (this.items[message.id] == undefined) {  // new download
             let download = {
                 state: states.downloading,
                 url: message.url,
+                origUrl: this.pending[message.id].origUrl,
                 dir: message.dir,
                 filename: message.filename,
                 size: message.size,
@@ -318,6 +501,24 @@ class Downloads {
         }
     }
 
+    // an identical file already exists, not downloaded
+    handleSkipped(message) {
+        let pending = this.pending[message.id]
+        delete this.pending[message.id]
+        this.addIconKey(pending.icon, -1)
+        chrome.downloads.erase({ id: pending.browserId }, () => {
+            notify('Already downloaded', message.filename, message.id, notifyTimeout)
+        })
+    }
+
+    handleDiskFull(message) {
+        this.items[message.id].state = states.paused
+        notify('Disk full, download paused', 'Free some space in ' + message.dir + ' and resume it.', message.id)  // keep message
+        chrome.extension.getViews({ type: 'popup' })[0]?.update(message.id)  // popup.update
+        chrome.storage.local.set({ downloads: this.items })
+        this.updateBadge()
+    }
+
     handleFailed(message) {
         this.items[message.id].state = states.failed
         notify('Download failed', this.items[message.id].filename + '\n' + message.error, message.id)  // keep message
@@ -332,9 +533,12 @@ class Downloads {
         if (!download.length && message.length) {
             download.length = message.length
         }
-        if (message.filename) {
+        if (message.filename) {  // may be moved by the hooks
             download.filename = message.filename
         }
+        if (message.dir) {
+            download.dir = message.dir
+        }
         this.updateBadge()
         chrome.extension.getViews({ type: 'popup' })[0]?.update(message.id)  // popup.update
         for (let stat of ['percent', 'written', 'speed', 'eta', 'conns']) {
@@ -344,7 +548,9 @@ class Downloads {
             this.switchUpdates(false)
         }
         chrome.storage.local.set({ downloads: this.items })
-        if (this.settings.notify.end) {
+        if (message.warning) {  // from the hooks
+            notify('Download finished with warnings', download.filename + '\n' + message.warning, message.id)  // keep message
+        } else if (this.settings.notify.end) {
             notify('Download finished', download.filename, message.id, notifyTimeout)
         }
     }
@@ -359,6 +565,43 @@ class Downloads {
         this.updateBadge()
     }
 
+    handleNotResumable(message) {
+        this.items[message.id].unresumable = true
+        notify(message.error, 'Stop it again to pause anyway.', message.id, notifyTimeout)
+    }
+
+    // the link expired while downloading, get a new one through the browser
+    handleNeedUrl(message) {
+        let download = this.items[message.id]
+        if (download == undefined) {
+            return
+        }
+        download.needUrl = true
+        this.urlPending = message.id
+        notify('Refreshing link', download.filename, message.id, notifyTimeout)
+        chrome.downloads.download({ url: download.origUrl || download.url })
+    }
+
+    // the server wants credentials, ask the user in a small window
+    handleAuthRequired(message) {
+        let params = new URLSearchParams({ id: message.id, url: message.url, realm: message.realm || '' })
+        chrome.windows.create({
+            url: chrome.extension.getURL('auth.html?' + params),
+            type: 'popup',
+            width: 400,
+            height: 320,
+        })
+    }
+
+    // give the credentials to the waiting download, empty ones to give up
+    sendAuth(id, credentials) {
+        this.request({ type: 'auth', id, ...credentials }, reply => {
+            if (reply.error) {
+                notify('Authentication error', reply.error, id, notifyTimeout)
+            }
+        })
+    }
+
     handleError(message) {
         notify('Error', message.error, message.id)
     }
@@ -389,7 +632,22 @@ class Downloads {
             return
         }
         chrome.downloads.pause(item.id, () => {
-            if (this.urlPending) {  // refresh url for the waiting one and resume
+            if (this.urlPending && this.items[this.urlPending].needUrl) {  // give the running one its new url
+                chrome.downloads.search({ id: item.id }, items => {
+                    let id = this.urlPending
+                    delete this.items[id].needUrl
+                    this.items[id].url = items[0].finalUrl
+                    this.urlPending = undefined
+                    this.request({ type: 'need-url', id, url: items[0].finalUrl }, reply => {
+                        if (reply.error) {
+                            notify('Refreshing link failed', reply.error, id, notifyTimeout)
+                        }
+                    })
+                    chrome.downloads.erase({ id: item.id })
+                    chrome.storage.local.set({ downloads: this.items })
+                })
+                return
+            } else if (this.urlPending) {  // refresh url for the waiting one and resume
                 chrome.downloads.search({ id: item.id }, items => {
                     item = items[0]
                     let down = this.items[this.urlPending]
@@ -409,7 +667,7 @@ class Downloads {
                     let iconHash = hash32(iconUrl)
                     this.addIconKey(iconHash, 1)
                     this.icons[iconHash].url = iconUrl
-                    this.add(item.id, item.finalUrl, dir, iconHash)
+                    this.add(item, dir, iconHash)
                 })
             })
         })
@@ -55,6 +55,7 @@ const progressBarColors = {
     [states.failed]: 'red',
     [states.paused]: 'grey',
     [states.rebuilding]: 'lightgreen',
+    [states.extracting]: 'lightgreen',
     [states.urlPending]: 'orange',
 }
 
@@ -62,6 +63,7 @@ const staticMsgs = {
     [states.paused]: 'Paused',
     [states.failed]: 'Failed',
     [states.rebuilding]: 'Rebuilding...',
+    [states.extracting]: 'Extracting...',
     [states.urlPending]: 'Waiting for new URL...',
 }
 
@@ -73,15 +75,17 @@ const buttonsOnItems = {
     open: document.getElementById('open'),
     folder: document.getElementById('folder'),
     remove: document.getElementById('remove'),
+    delete: document.getElementById('delete'),
 }
 
 const buttonsByState = {
-    [states.downloading]: ['pause', 'copyUrl'],
-    [states.failed]: ['resume', 'copyUrl', 'changeUrl', 'remove'],
-    [states.paused]: ['resume', 'copyUrl', 'changeUrl', 'remove'],
+    [states.downloading]: ['pause', 'copyUrl', 'delete'],
+    [states.failed]: ['resume', 'copyUrl', 'changeUrl', 'remove', 'delete'],
+    [states.paused]: ['resume', 'copyUrl', 'changeUrl', 'remove', 'delete'],
     [states.rebuilding]: ['copyUrl'],
-    [states.urlPending]: ['resume', 'copyUrl', 'remove'],
-    [states.completed]: ['copyUrl', 'open', 'folder', 'remove'],
+    [states.extracting]: ['copyUrl'],
+    [states.urlPending]: ['resume', 'copyUrl', 'remove', 'delete'],
+    [states.completed]: ['copyUrl', 'open', 'folder', 'remove', 'delete'],
 }
 
 customElements.define('download-item', class extends HTMLElement {
@@ -154,12 +158,12 @@ customElements.define('download-item', class extends HTMLElement {
         // not completed
         this.size.innerText = this.data.written + ' / ' + this.data.size
         let lastPartI = this.data.state == states.downloading ? partsNames.length : 1
-        let percent = (Math.round(this.data.percent * 100) / 100) + '%'
+        let percent = this.data.percent < 0 ? '?' : (Math.round(this.data.percent * 100) / 100) + '%'
         for (let name of partsNames.slice(0, lastPartI)) {
             let elm = this[name]
             switch (name) {
                 case 'progress':
-                    elm.style.width = percent
+                    elm.style.width = this.data.percent < 0 ? '100%' : percent  // unknown length, full bar
                     elm.style.background = progressBarColors[this.data.state]
                     break
                 case 'percent':
@@ -236,6 +240,21 @@ document.getElementById('remove').addEventListener('click', event => {
     }
 })
 
+document.getElementById('delete').addEventListener('click', event => {
+    event.preventDefault()
+    if (lastFocusItem == null) return
+    let download = downloads.items[lastFocusItem.id]
+    if (!confirm(`Delete ${download.filename} from the disk?`)) return
+    if (downloads.delete(Number(lastFocusItem.id))) {
+        lastFocusItem.remove()
+        lastFocusItem = undefined
+        // update buttons
+        for (let butt of Object.values(buttonsOnItems)) {
+            butt.style.display = 'none'
+        }
+    }
+})
+
 function pauseResume(event) {
     event.preventDefault()
     if (lastFocusItem == null) return
@@ -322,6 +341,8 @@ document.getElementById('settings').addEventListener('change', event => {
         settingsElements = {
             categories: document.getElementById('categories'),
             conns: document.getElementById('conns'),
+            conflict: document.getElementById('conflict'),
+            extract: document.getElementById('extract'),
             notify: {
                 begin: document.getElementById('notify-begin'),
                 end: document.getElementById('notify-end'),
@@ -364,6 +385,8 @@ function parseCats(cats) {
 
 function retrieveSettings() {
     settingsElements.conns.value = downloads.settings.conns
+    settingsElements.conflict.value = downloads.settings.conflict || 'rename'
+    settingsElements.extract.checked = downloads.settings.extract || false
     let cats = []
     for (let [name, exts] of Object.entries(downloads.settings.categories)) {
         cats.push(name + ': ' + exts.join(' '))
@@ -377,6 +400,8 @@ document.getElementById('save-settings').addEventListener('click', event => {
     event.preventDefault()
     let settings = {
         conns: Number(settingsElements.conns.value),
+        conflict: settingsElements.conflict.value,
+        extract: settingsElements.extract.checked,
         categories: parseCats(settingsElements.categories.value),
         notify: {
             begin: settingsElements.notify.begin.checked,